@@ -0,0 +1,111 @@
+package postfix
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// autoWhiteList holds the senders promoted for staying under their limit and when their promotion expires,
+// the settings are protected by the lock of the RatelimitSlidingWindow and the senders by its own lock, which lookups
+// only read lock so concurrent decisions do not serialize on it
+type autoWhiteList struct {
+	mu      sync.RWMutex
+	windows int
+	ttl     time.Duration
+	senders map[string]time.Time
+}
+
+func newAutoWhiteList() *autoWhiteList {
+	var al autoWhiteList
+	al.senders = make(map[string]time.Time)
+	return &al
+}
+
+// SetAutoWhiteList enables promoting senders without a deferred message for the given number of intervals into an
+// automatic white list for ttl, a single deferred message demotes them. A windows value of 0 disables the feature.
+func (rsw *RatelimitSlidingWindow) SetAutoWhiteList(windows int, ttl time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.auto.windows = windows
+	rsw.auto.ttl = ttl
+	if windows < 1 {
+		rsw.auto.mu.Lock()
+		rsw.auto.senders = make(map[string]time.Time)
+		rsw.auto.mu.Unlock()
+	}
+}
+
+// AutoWhiteList returns the senders currently on the automatic white list
+func (rsw *RatelimitSlidingWindow) AutoWhiteList() []string {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	now := rsw.now()
+	rsw.auto.mu.RLock()
+	defer rsw.auto.mu.RUnlock()
+	res := make([]string, 0, len(rsw.auto.senders))
+	for k, exp := range rsw.auto.senders {
+		if now.Before(exp) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// autoWhiteListed reports whether the sender is on the automatic white list, dropping it if its promotion expired.
+// It takes no lock at all while the feature is disabled.
+func (rsw *RatelimitSlidingWindow) autoWhiteListed(sender string, now time.Time) bool {
+	if rsw.auto.windows < 1 {
+		return false
+	}
+	rsw.auto.mu.RLock()
+	exp, ok := rsw.auto.senders[sender]
+	rsw.auto.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if now.Before(exp) {
+		return true
+	}
+	rsw.auto.mu.Lock()
+	defer rsw.auto.mu.Unlock()
+	if exp, ok := rsw.auto.senders[sender]; ok && !now.Before(exp) { // it may have been promoted again meanwhile
+		delete(rsw.auto.senders, sender)
+		rsw.logger.Println("Automatic white listing of", sender, "expired")
+	}
+	return false
+}
+
+// autoPromote puts the sender of a permitted message on the automatic white list if it behaved long enough
+func (rsw *RatelimitSlidingWindow) autoPromote(req *RatelimitRequest) {
+	if rsw.auto.windows < 1 {
+		return
+	}
+	if req.Time.Sub(req.token.cleanSince()) < time.Duration(rsw.auto.windows)*req.Interval {
+		return
+	}
+	rsw.auto.mu.Lock()
+	rsw.auto.senders[req.Sender] = req.Time.Add(rsw.auto.ttl)
+	rsw.auto.mu.Unlock()
+	rsw.logger.Println("Automatically white listing", req.Sender, "until", req.Time.Add(rsw.auto.ttl))
+}
+
+// autoDemote removes the sender of a deferred message from the automatic white list
+func (rsw *RatelimitSlidingWindow) autoDemote(sender string) {
+	if rsw.auto.windows < 1 {
+		return
+	}
+	rsw.auto.mu.RLock()
+	_, ok := rsw.auto.senders[sender]
+	rsw.auto.mu.RUnlock()
+	if !ok {
+		return
+	}
+	rsw.auto.mu.Lock()
+	defer rsw.auto.mu.Unlock()
+	if _, ok := rsw.auto.senders[sender]; ok {
+		delete(rsw.auto.senders, sender)
+		rsw.logger.Println("Removed", sender, "from the automatic white list")
+	}
+}
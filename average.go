@@ -0,0 +1,54 @@
+package postfix
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// SetAverageRate sets the average rate in messages per second over the window a sender is deferred above, 0 compares the count to the limit
+func (rsw *RatelimitSlidingWindow) SetAverageRate(perSecond float64) error {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if perSecond < 0 || math.IsInf(perSecond, 0) || math.IsNaN(perSecond) {
+		return fmt.Errorf("invalid average rate %v, it must be a positive number of messages per second or 0", perSecond)
+	}
+	rsw.avgRate = perSecond
+	return nil
+}
+
+// overAverage reports whether messages in the window of the token, including the ones of the request, exceed the
+// average rate, setting the retry time of the request to when they would not
+func (rsw *RatelimitSlidingWindow) overAverage(req *RatelimitRequest, t *RatelimitToken, messages int64) bool {
+	span := t.span(req.Time, req.Interval)
+	if float64(messages)/span.Seconds() <= rsw.avgRate {
+		return false
+	}
+	retry := time.Duration(float64(messages)/rsw.avgRate*float64(time.Second)) - span
+	if retry > req.Interval {
+		retry = req.Interval
+	}
+	req.retry = retry
+	return true
+}
+
+// span returns the time the slices of the token cover at now, from the start of the oldest one, at most interval
+// and at least one slice
+func (rlt *RatelimitToken) span(now time.Time, interval time.Duration) time.Duration {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	oldest := rlt.index(now)
+	for i := range rlt.tsd {
+		if i < oldest {
+			oldest = i
+		}
+	}
+	d := now.Sub(rlt.start(oldest))
+	if d > interval {
+		d = interval
+	}
+	if d < rlt.slice {
+		d = rlt.slice
+	}
+	return d
+}
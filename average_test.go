@@ -0,0 +1,50 @@
+package postfix
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// The average is the messages in the window divided by the time they span, from the start of the oldest slice, so it
+// is at least a slice and at most the interval. A sender sending a burst is thus deferred early in the burst whatever
+// the limit, while one ramping up smoothly is not. A few messages in a single slice can already exceed a rate easily
+// sustained over the whole window, so short windows need a rate sized for one slice.
+func TestAverageRateDefersBursts(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetClock(mc)
+	rsw.SetDefaultLimit(1000)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsw.SetAverageRate(1.0 / 60); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ { // one every two minutes stays below the rate of one a minute
+		if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d sent below the average rate = %q", i, got)
+		}
+		mc.Advance(2 * time.Minute)
+	}
+	rsw.RateLimit("alice@example.com", 1)
+	if got := rsw.RateLimit("alice@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("a burst far below the limit was permitted over the average rate")
+	}
+	if err := rsw.SetAverageRate(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := rsw.RateLimit("alice@example.com", 1); got != "action=dunno\n\n" {
+		t.Errorf("message under the limit without an average rate = %q", got)
+	}
+}
+
+func TestSetAverageRateInvalid(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	for _, r := range []float64{-1, math.NaN(), math.Inf(1)} {
+		if err := rsw.SetAverageRate(r); err == nil {
+			t.Errorf("SetAverageRate(%v) accepted", r)
+		}
+	}
+}
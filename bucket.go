@@ -0,0 +1,337 @@
+package postfix
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBucketCapacity is the number of messages a sender may send at once with a RatelimitTokenBucket
+const DefaultBucketCapacity = 120
+
+// RateLimiter decides whether messages of a sender are permitted, answering with a postfix policy response.
+// RatelimitSlidingWindow and RatelimitTokenBucket implement it, so a PolicyServer can serve either.
+type RateLimiter interface {
+	RateLimit(sender string, recips int) string
+	RateLimitRequest(p *Policy) string
+}
+
+// RatelimitTokenBucket limits senders with a token bucket refilled at a steady rate instead of a sliding window,
+// every recipient takes a token and otherwise messages are decided like a RatelimitSlidingWindow decides them
+type RatelimitTokenBucket struct {
+	mu       sync.RWMutex            // protects capacity and rate, read while the lock of rsw is held
+	rsw      *RatelimitSlidingWindow // makes the decisions, with a chain ending in the policy of the bucket
+	capacity int
+	rate     float64 // tokens per second
+	report   func(sender string, recips int, left float64, capacity int, taken bool)
+	bmu      sync.Mutex // protects buckets, taken while holding the lock of rsw
+	buckets  map[string]*bucket
+}
+
+// bucket is the token bucket of a sender, holding tokens as of at
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// NewRatelimitTokenBucket creates a structure of type RatelimitTokenBucket, with a capacity of DefaultBucketCapacity
+// refilled in an hour
+func NewRatelimitTokenBucket(w, d *MemoryMap) *RatelimitTokenBucket {
+	var rtb RatelimitTokenBucket
+	rtb.rsw = NewRatelimitSlidingWindow(w, d, NewRatelimitTokenMap(1))
+	rtb.rsw.SetChain(Chain{rtb.rsw.WhiteListPolicy(), rtb.Policy()})
+	rtb.capacity = DefaultBucketCapacity
+	rtb.rate = float64(DefaultBucketCapacity) / time.Hour.Seconds()
+	rtb.report = rtb.logTokens
+	rtb.buckets = make(map[string]*bucket)
+	return &rtb
+}
+
+// SetCapacity sets the number of tokens the bucket of a sender holds, the largest burst of recipients it may send
+func (rtb *RatelimitTokenBucket) SetCapacity(c int) error {
+	rtb.mu.Lock()
+	defer rtb.mu.Unlock()
+	if c < 1 {
+		return fmt.Errorf("%w: capacity %d must be at least 1", ErrInvalidLimit, c)
+	}
+	rtb.capacity = c
+	return nil
+}
+
+// SetRate sets how many tokens per second are added to the bucket of a sender, the rate a sender may send at on average
+func (rtb *RatelimitTokenBucket) SetRate(perSecond float64) error {
+	rtb.mu.Lock()
+	defer rtb.mu.Unlock()
+	if perSecond <= 0 || math.IsInf(perSecond, 0) || math.IsNaN(perSecond) {
+		return fmt.Errorf("invalid refill rate %v, it must be a positive number of tokens per second", perSecond)
+	}
+	rtb.rate = perSecond
+	return nil
+}
+
+// SetWhiteList sets the white list like the SetWhiteList of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) SetWhiteList(wl *MemoryMap) {
+	rtb.rsw.SetWhiteList(wl)
+}
+
+// SetNetWhiteList sets the networks white listed by client address like the SetNetWhiteList of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) SetNetWhiteList(m *CIDRMap) {
+	rtb.rsw.SetNetWhiteList(m)
+}
+
+// SetDomainList sets the domain list, it may be called at any time to swap in a reloaded list. An entry like "50 10m"
+// gives the senders of the domain a capacity of 50 refilled in 10 minutes, one without an interval only sets the capacity.
+// The buckets are kept, the new capacities and rates apply to them from the next message on.
+func (rtb *RatelimitTokenBucket) SetDomainList(d *MemoryMap) {
+	rtb.rsw.SetDomainList(d)
+}
+
+// SetDeferMessage sets the text of the response deferring a message, it may contain the placeholders of the
+// SetDeferMessage of a RatelimitSlidingWindow, {limit} being the capacity, {remaining} the tokens left and {retry} the
+// time until the bucket holds enough tokens for the message
+func (rtb *RatelimitTokenBucket) SetDeferMessage(m string) {
+	rtb.rsw.SetDeferMessage(m)
+}
+
+// SetDeferStatus sets the enhanced status code sent ahead of the defer message like the SetDeferStatus of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) SetDeferStatus(s string) {
+	rtb.rsw.SetDeferStatus(s)
+}
+
+// SetLimitAction sets the action returned for a sender with too few tokens, DeferIfPermit by default
+func (rtb *RatelimitTokenBucket) SetLimitAction(a LimitAction) {
+	rtb.rsw.SetLimitAction(a)
+}
+
+// SetReasonTags sets whether deferred messages get the reason code of the decision appended to their text
+func (rtb *RatelimitTokenBucket) SetReasonTags(t bool) {
+	rtb.rsw.SetReasonTags(t)
+}
+
+// SetWhiteListOK makes white list matches answer action=ok instead of dunno like the SetWhiteListOK of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) SetWhiteListOK(ok bool) {
+	rtb.rsw.SetWhiteListOK(ok)
+}
+
+// SetFoldCase sets whether senders are folded to lower case like the SetFoldCase of a RatelimitSlidingWindow, it is on by default
+func (rtb *RatelimitTokenBucket) SetFoldCase(f bool) {
+	rtb.rsw.SetFoldCase(f)
+}
+
+// SetStripSubAddress sets whether every +tag of an address shares its bucket like the SetStripSubAddress of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) SetStripSubAddress(s bool) {
+	rtb.rsw.SetStripSubAddress(s)
+}
+
+// SetMatchSubAddress sets whether a sender like user+tag@example.com also matches a user@example.com white list entry
+func (rtb *RatelimitTokenBucket) SetMatchSubAddress(m bool) {
+	rtb.rsw.SetMatchSubAddress(m)
+}
+
+// SetWildcardDomains sets whether the white list and the domain list match wildcard entries like *.example.com
+func (rtb *RatelimitTokenBucket) SetWildcardDomains(w bool) {
+	rtb.rsw.SetWildcardDomains(w)
+}
+
+// SetKeyExtractor sets the function RateLimitRequest uses to pick the key whose bucket a request takes tokens from
+func (rtb *RatelimitTokenBucket) SetKeyExtractor(f KeyExtractor) {
+	rtb.rsw.SetKeyExtractor(f)
+}
+
+// SetTerminator sets the string ending every response, PolicyTerminator by default
+func (rtb *RatelimitTokenBucket) SetTerminator(t string) {
+	rtb.rsw.SetTerminator(t)
+}
+
+// SetClock makes the buckets refill by the time of c, nil switches back to the system clock
+func (rtb *RatelimitTokenBucket) SetClock(c Clock) {
+	rtb.rsw.SetClock(c)
+}
+
+// SetLogger sets the logger on the RatelimitTokenBucket, nil discards the messages as before any logger is set
+func (rtb *RatelimitTokenBucket) SetLogger(l *log.Logger) {
+	rtb.rsw.SetLogger(l)
+}
+
+// RateLimitRequest extracts the sender, recipient and recipient_count attributes from a policy request and rate limits
+// the sender with them like the RateLimitRequest of a RatelimitSlidingWindow
+func (rtb *RatelimitTokenBucket) RateLimitRequest(p *Policy) string {
+	return rtb.rsw.RateLimitRequest(p)
+}
+
+// RateLimit takes a token for every recipient from the bucket of the sender, permitting the message if there are enough
+// and deferring it otherwise. A count of 0 recipients takes a single token.
+func (rtb *RatelimitTokenBucket) RateLimit(sender string, recips int) string {
+	return rtb.rsw.RateLimit(sender, recips)
+}
+
+// Decide checks whether a sender can send the message like RateLimit, returning the whole decision
+func (rtb *RatelimitTokenBucket) Decide(sender string, recips int) Decision {
+	return rtb.rsw.Decide(sender, recips)
+}
+
+// Policy returns the policy taking the tokens of a message from the bucket of its key, deferring the message if there
+// are too few. It ends the chain of the RatelimitTokenBucket, in place of the limit and sender policies of a window.
+func (rtb *RatelimitTokenBucket) Policy() PolicyRule {
+	return PolicyFunc(func(req *RatelimitRequest) (Action, bool) {
+		rsw := rtb.rsw
+		k, capacity, rate, ok := rtb.limits(req.Domain)
+		if ok {
+			rsw.hit(req, &rsw.hits.domainList, k)
+		}
+		if ok && capacity == Unlimited {
+			rsw.logger.Println("Allowing unlimited domain:", k, "for sender:", req.Sender, req.ref())
+			rsw.whiteListed(req)
+			return Action{Name: "dunno"}, true // permit domain listed without a limit
+		}
+		req.domain = ok
+
+		n := req.needed()
+		rtb.bmu.Lock()
+		b, found := rtb.buckets[req.Key]
+		if !found {
+			b = &bucket{tokens: float64(capacity), at: req.Time}
+			if !req.DryRun {
+				rtb.buckets[req.Key] = b
+			}
+		}
+		var left float64
+		taken := false
+		if req.DryRun {
+			left = b.level(capacity, rate, req.Time)
+			taken = left >= float64(n)
+		} else {
+			left, taken = b.take(n, capacity, rate, req.Time)
+		}
+		rtb.bmu.Unlock()
+
+		req.Limit = capacity
+		req.count = int64(capacity) - int64(left)
+		if req.DryRun {
+			if !taken {
+				return rsw.deferAction(""), true
+			}
+			return Action{}, false
+		}
+		rtb.report(req.Sender, n, left, capacity, taken)
+		if !taken {
+			req.retry = refill(n, left, capacity, rate)
+			if req.domain {
+				return rsw.deferAction("rl-domain"), true
+			}
+			return rsw.deferAction("rl-sender"), true
+		}
+		if req.domain {
+			atomic.AddInt64(&rsw.counters.PermittedDomain, 1)
+		} else {
+			atomic.AddInt64(&rsw.counters.PermittedDefault, 1)
+		}
+		return Action{}, false
+	})
+}
+
+// logTokens logs the outcome of a message with the tokens left in the bucket of its sender, it is the report of a
+// RatelimitTokenBucket, which a RatelimitLeakyBucket replaces with logScore
+func (rtb *RatelimitTokenBucket) logTokens(sender string, recips int, left float64, capacity int, taken bool) {
+	if !taken {
+		rtb.rsw.logger.Println("Message from", sender, "deferred, bucket holds", int(left), "of", recips, "tokens needed")
+		return
+	}
+	rtb.rsw.logger.Println("Message accepted from", sender, "recipients", recips, "tokens left", int(left), "capacity", capacity)
+}
+
+// limits returns the capacity and refill rate of the buckets of a domain, those of its domain list entry if it has one
+// and the default ones otherwise, the default rate if the entry has no interval. It reports the key of the entry, which
+// may be a wildcard entry, and whether the entry set the limits, an invalid one is logged and leaves the defaults.
+// It is called with the lock of rsw held.
+func (rtb *RatelimitTokenBucket) limits(domain string) (key string, capacity int, rate float64, ok bool) {
+	rtb.mu.RLock()
+	capacity, rate = rtb.capacity, rtb.rate
+	rtb.mu.RUnlock()
+	k, listed := rtb.rsw.checkDomain(domain)
+	if !listed {
+		return "", capacity, rate, false
+	}
+	limit, interval, ok := rtb.rsw.getDomainLimit(k)
+	if !ok {
+		return k, capacity, rate, false
+	}
+	if interval > 0 {
+		return k, limit, float64(limit) / interval.Seconds(), true
+	}
+	return k, limit, rate, true
+}
+
+// domainOf returns the domain of an address, empty if it has none
+func domainOf(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return addr[at+1:]
+	}
+	return ""
+}
+
+// refill returns how long until a bucket holding left tokens holds n at rate, how long until it is full if it never does
+func refill(n int, left float64, capacity int, rate float64) time.Duration {
+	need := float64(n)
+	if n > capacity {
+		need = float64(capacity)
+	}
+	return time.Duration((need - left) / rate * float64(time.Second))
+}
+
+// level returns the tokens the bucket holds at now, refilled for the time passed since it was last used up to its capacity
+func (b *bucket) level(capacity int, rate float64, now time.Time) float64 {
+	t := b.tokens
+	if d := now.Sub(b.at); d > 0 {
+		t += d.Seconds() * rate
+	}
+	return math.Min(t, float64(capacity))
+}
+
+// take refills the bucket and takes n tokens if it holds as many, returning the tokens left and whether they were taken
+func (b *bucket) take(n, capacity int, rate float64, now time.Time) (float64, bool) {
+	b.tokens = b.level(capacity, rate, now)
+	if now.After(b.at) {
+		b.at = now
+	}
+	if b.tokens < float64(n) {
+		return b.tokens, false
+	}
+	b.tokens -= float64(n)
+	return b.tokens, true
+}
+
+// Reap drops the buckets of senders idle for olderThan that refilled by now, a dropped bucket starts full again when
+// its sender sends, so no sender gains tokens by being reaped. It returns the number of buckets dropped.
+func (rtb *RatelimitTokenBucket) Reap(olderThan time.Duration) int {
+	rtb.rsw.mu.RLock()
+	defer rtb.rsw.mu.RUnlock()
+	now := rtb.rsw.now()
+	cutoff := now.Add(-olderThan)
+	rtb.bmu.Lock()
+	defer rtb.bmu.Unlock()
+	n := 0
+	for k, b := range rtb.buckets {
+		if b.at.After(cutoff) {
+			continue
+		}
+		_, capacity, rate, _ := rtb.limits(domainOf(k))
+		if capacity == Unlimited || b.level(capacity, rate, now) >= float64(capacity) {
+			delete(rtb.buckets, k)
+			n++
+		}
+	}
+	if n > 0 {
+		rtb.rsw.logger.Println("Reaped", n, "buckets idle for", olderThan, len(rtb.buckets), "left")
+	}
+	return n
+}
+
+// StartReaper reaps the buckets idle for maxIdle every interval until stop is called
+func (rtb *RatelimitTokenBucket) StartReaper(interval, maxIdle time.Duration) (stop func()) {
+	return every(interval, func() { rtb.Reap(maxIdle) })
+}
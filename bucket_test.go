@@ -0,0 +1,99 @@
+package postfix
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurstAndSteadyState(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rtb := NewRatelimitTokenBucket(NewMemoryMap(), NewMemoryMap())
+	rtb.SetClock(mc)
+	if err := rtb.SetCapacity(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := rtb.SetRate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := rtb.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d of the burst = %q, want it permitted", i, got)
+		}
+	}
+	if got := rtb.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Fatal("message beyond the burst permitted")
+	}
+	for i := 0; i < 30; i++ {
+		mc.Advance(time.Second)
+		if got := rtb.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d at the refill rate = %q, want it permitted", i, got)
+		}
+		if got := rtb.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+			t.Fatalf("second message %d within a second permitted over the refill rate", i)
+		}
+	}
+}
+
+func TestTokenBucketRetryAfter(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rtb := NewRatelimitTokenBucket(NewMemoryMap(), NewMemoryMap())
+	rtb.SetClock(mc)
+	rtb.SetCapacity(10)
+	rtb.SetRate(0.5)
+	rtb.SetDeferMessage("{remaining} left, retry in {retry_after}s")
+
+	rtb.RateLimit("bob@example.com", 9)
+	d := rtb.Decide("bob@example.com", 5)
+	if d.RetryAfter != 8*time.Second {
+		t.Errorf("RetryAfter = %s, want 8s for 4 tokens at 0.5 per second", d.RetryAfter)
+	}
+	if d.Response != "action=defer_if_permit 1 left, retry in 8s\n\n" {
+		t.Errorf("response = %q", d.Response)
+	}
+}
+
+func TestTokenBucketSharesWindowPlumbing(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"*.Partner.com": ""})
+	networks := NewCIDRMap()
+	if err := networks.Add("192.0.2.0/24", ""); err != nil {
+		t.Fatal(err)
+	}
+	rtb := NewRatelimitTokenBucket(wl, NewMemoryMapFrom(map[string]string{"*.example.org": "0"}))
+	rtb.SetClock(NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)))
+	rtb.SetCapacity(1)
+	rtb.SetWildcardDomains(true)
+	rtb.SetNetWhiteList(networks)
+	rtb.SetLimitAction(Defer)
+	rtb.SetDeferStatus("4.7.28")
+	rtb.SetReasonTags(true)
+	rtb.SetStripSubAddress(true)
+	rtb.SetKeyExtractor(func(p *Policy) (string, int, bool) {
+		return p.Attribute("client_address"), 0, p.Attribute("client_address") != ""
+	})
+
+	for i := 0; i < 3; i++ {
+		if got := rtb.RateLimit("bob@mail.partner.com", 5); got != "action=dunno\n\n" {
+			t.Fatalf("sender of a wildcard white listed domain = %q", got)
+		}
+		if got := rtb.RateLimit("bob@lists.example.org", 5); got != "action=dunno\n\n" {
+			t.Fatalf("sender of an unlimited wildcard domain = %q", got)
+		}
+	}
+
+	rtb.RateLimit("Bob+News@Example.com", 1)
+	if got := rtb.RateLimit("bob@example.com", 1); got != "action=defer 4.7.28 rate limit exceeded [rl-sender]\n\n" {
+		t.Errorf("normalized sender over its capacity = %q, want the configured action, status and reason", got)
+	}
+
+	p, err := ParsePolicyRequest(bufio.NewReader(strings.NewReader(
+		"request=smtpd_access_policy\nsender=alice@example.net\nclient_address=192.0.2.7\nrecipient_count=5\n\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rtb.RateLimitRequest(p); got != "action=dunno\n\n" {
+		t.Errorf("client on the network white list = %q", got)
+	}
+}
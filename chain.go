@@ -0,0 +1,227 @@
+package postfix
+
+import "time"
+
+// PolicyTerminator ends every response of the postfix policy protocol, an empty line after the action
+const PolicyTerminator = "\n\n"
+
+// LimitAction is the kind of action returned when a limit is exceeded
+type LimitAction int
+
+const (
+	// DeferIfPermit defers the message unless a later restriction rejects it, it may let mail through if a later restriction permits it
+	DeferIfPermit LimitAction = iota
+	// Defer defers the message unconditionally
+	Defer
+	// Reject rejects the message permanently
+	Reject
+)
+
+// String returns the postfix name of the LimitAction
+func (la LimitAction) String() string {
+	switch la {
+	case Defer:
+		return "defer"
+	case Reject:
+		return "reject"
+	}
+	return "defer_if_permit"
+}
+
+// Action is a postfix policy action with its optional text
+// Every policy of a chain sets its own Status, Text and Reason, so a greylisting defer ("4.7.1 greylisted")
+// stays distinguishable from a rate limit defer ("4.7.28 rate limit exceeded") in the postfix logs.
+type Action struct {
+	Name   string
+	Status string // optional enhanced status code like 4.7.1, sent ahead of the text
+	Text   string
+	Reason string // short machine readable code of the rule that made the decision
+}
+
+// String formats the Action as a postfix policy response
+func (a Action) String() string {
+	return a.Format(PolicyTerminator)
+}
+
+// Format formats the Action ending it with the given terminator instead of PolicyTerminator
+func (a Action) Format(term string) string {
+	res := "action=" + a.Name
+	if a.Status != "" {
+		res += " " + a.Status
+	}
+	if a.Text != "" {
+		res += " " + a.Text
+	}
+	return res + term
+}
+
+// tagged returns the Action with its reason code appended to the text
+func (a Action) tagged() Action {
+	if a.Reason == "" || a.permits() {
+		return a
+	}
+	if a.Text == "" {
+		a.Text = "[" + a.Reason + "]"
+	} else {
+		a.Text += " [" + a.Reason + "]"
+	}
+	return a
+}
+
+// permits reports whether the Action lets the message through
+func (a Action) permits() bool {
+	return a.Name == "dunno" || a.Name == "ok"
+}
+
+// RatelimitRequest holds the data of a single rate limit decision as it is passed along a Chain
+type RatelimitRequest struct {
+	Sender     string
+	Key        string // the key the message is accounted under, the sender unless a KeyExtractor picks another
+	Domain     string
+	Recipients int
+	Recipient  string        // a recipient address if known, for limits of sender and recipient domain pairs
+	Limit      int           // the limit applicable to the sender, policies earlier in the chain may change it
+	Interval   time.Duration // the window the limit applies to
+	Time       time.Time
+	QueueID    string // queue_id and instance of the policy request if known, for correlating with the mail log
+	Instance   string
+	DryRun     bool // set when the decision must not change any state, policies should then only look
+
+	token    *RatelimitToken // set by the sender policy when the message fits in the sender's limit
+	keyLimit int             // limit picked by the KeyExtractor
+	count    int64           // messages of the key in the window before this one, set by the sender policy
+	retry    time.Duration   // how long until the deferred message would fit, set by the policy deferring it
+	match    ListMatch       // set by the white list policy
+	domain   bool            // set by the limit policy when the limit comes from the domain list
+	global   bool            // set by the global policy when the message fits in the global limit
+	held     []*RatelimitToken
+}
+
+// hold locks the token for the rest of the decision, so concurrent messages of a key cannot all pass the same check
+// before any of them is recorded
+func (r *RatelimitRequest) hold(t *RatelimitToken) {
+	for _, h := range r.held {
+		if h == t {
+			return
+		}
+	}
+	t.busy.Lock()
+	r.held = append(r.held, t)
+}
+
+// release unlocks the tokens held by the request in reverse order
+func (r *RatelimitRequest) release() {
+	for i := len(r.held) - 1; i >= 0; i-- {
+		r.held[i].busy.Unlock()
+	}
+	r.held = nil
+}
+
+// ref returns the postfix identifiers of the request for log lines
+func (r *RatelimitRequest) ref() string {
+	if r.QueueID == "" && r.Instance == "" {
+		return ""
+	}
+	return "queue_id=" + r.QueueID + " instance=" + r.Instance
+}
+
+// needed returns the recipient count a limit must still have room for, a zero count is checked like a single recipient
+func (r *RatelimitRequest) needed() int {
+	if r.Recipients == 0 {
+		return 1
+	}
+	return r.Recipients
+}
+
+// Decision is the outcome of a rate limit check along with the data it was based on
+type Decision struct {
+	Sender     string
+	Key        string
+	Domain     string
+	Recipients int
+	Count      int64 // messages of the key in the window before this one, 0 if the sender policy was not reached
+	Limit      int
+	Action     Action
+	Response   string        // the response sent to postfix
+	RetryAfter time.Duration // for deferred messages how long until the message would fit in the limit, with jitter
+	QueueID    string
+	Instance   string
+	Time       time.Time
+	WhiteList  ListMatch // the white list entry permitting the message, if any
+}
+
+// MatchForm is the form of the sender a list entry matched
+type MatchForm int
+
+const (
+	// MatchNone means no entry matched
+	MatchNone MatchForm = iota
+	// MatchSender is a match of the full sender address
+	MatchSender
+	// MatchSubAddress is a match of the sender address without its +tag
+	MatchSubAddress
+	// MatchDomain is a match of the sender domain
+	MatchDomain
+	// MatchAuto is a match on the automatic white list
+	MatchAuto
+	// MatchLocal is an exempted local sender without a domain
+	MatchLocal
+	// MatchClient is a match of the client address a KeyExtractor keyed the message by, exactly or by its network
+	MatchClient
+)
+
+// String returns the name of the MatchForm
+func (mf MatchForm) String() string {
+	switch mf {
+	case MatchSender:
+		return "sender"
+	case MatchSubAddress:
+		return "subaddress"
+	case MatchDomain:
+		return "domain"
+	case MatchAuto:
+		return "auto"
+	case MatchLocal:
+		return "local"
+	case MatchClient:
+		return "client"
+	}
+	return "none"
+}
+
+// ListMatch is a list entry a decision was based on, the form of the sender it matched and its key
+type ListMatch struct {
+	Form MatchForm
+	Key  string
+}
+
+// Permitted reports whether the message was let through
+func (d Decision) Permitted() bool {
+	return d.Action.permits()
+}
+
+// PolicyRule is a single step of a Chain, returning true from Evaluate ends the chain with the returned Action
+type PolicyRule interface {
+	Evaluate(req *RatelimitRequest) (Action, bool)
+}
+
+// PolicyFunc is an adapter to use ordinary functions as a PolicyRule
+type PolicyFunc func(req *RatelimitRequest) (Action, bool)
+
+// Evaluate calls f(req)
+func (f PolicyFunc) Evaluate(req *RatelimitRequest) (Action, bool) {
+	return f(req)
+}
+
+// Chain is an ordered list of policy rules evaluated until one of them makes a decision
+type Chain []PolicyRule
+
+// Evaluate runs the rules of the chain in order and returns the first decision made
+func (c Chain) Evaluate(req *RatelimitRequest) (Action, bool) {
+	for _, p := range c {
+		if a, ok := p.Evaluate(req); ok {
+			return a, true
+		}
+	}
+	return Action{}, false
+}
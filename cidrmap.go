@@ -0,0 +1,165 @@
+package postfix
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// CIDRMap is a lock protected map of network prefixes and exact keys, looking up an address finds its longest matching prefix
+type CIDRMap struct {
+	mu    sync.RWMutex
+	exact map[string]string
+	v4    *cidrNode
+	v6    *cidrNode
+	n     int
+}
+
+// cidrNode is a node of a binary trie over the bits of an address, set nodes end a prefix
+type cidrNode struct {
+	child [2]*cidrNode
+	set   bool
+	value string
+}
+
+// NewCIDRMap creates a new CIDRMap structure
+func NewCIDRMap() *CIDRMap {
+	var m CIDRMap
+	m.exact = make(map[string]string)
+	m.v4 = &cidrNode{}
+	m.v6 = &cidrNode{}
+	return &m
+}
+
+// LoadCIDR loads a map file into a CIDRMap like Load, keys containing a / are parsed as network prefixes, all others are
+// exact keys. An invalid prefix gives a *MapError wrapping ErrMalformedLine for the first line it is on.
+func LoadCIDR(filename string) (*CIDRMap, error) {
+	res := NewCIDRMap()
+	if filename == "" {
+		return res, nil
+	}
+	f, err := openMap(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = scanMap(f, filename, true, func(line int, k, v, note string) error {
+		if err := res.Add(k, v); err != nil {
+			return fmt.Errorf("%w: %s", ErrMalformedLine, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Add adds a network prefix like 10.0.0.0/8 or an exact key to the map
+func (m *CIDRMap) Add(k, v string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !strings.Contains(k, "/") {
+		if _, ok := m.exact[k]; !ok {
+			m.n++
+		}
+		m.exact[k] = v
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(k)
+	if err != nil {
+		return fmt.Errorf("invalid network %q: %s", k, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+	node := m.root(ipnet.IP)
+	ip := normalizeIP(ipnet.IP)
+	for i := 0; i < ones; i++ {
+		b := ip[i/8] >> (7 - uint(i%8)) & 1
+		if node.child[b] == nil {
+			node.child[b] = &cidrNode{}
+		}
+		node = node.child[b]
+	}
+	if !node.set {
+		m.n++
+	}
+	node.set = true
+	node.value = v
+	return nil
+}
+
+// Get returns the value stored under k, or if k is an address the value of its longest matching prefix, or error if not found
+func (m *CIDRMap) Get(k string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if v, ok := m.exact[k]; ok {
+		return v, nil
+	}
+	ip := net.ParseIP(k)
+	if ip == nil {
+		return "", fmt.Errorf("Key not found")
+	}
+	node := m.root(ip)
+	ip = normalizeIP(ip)
+	found, value := node.set, node.value
+	for i := 0; i < len(ip)*8; i++ {
+		node = node.child[ip[i/8]>>(7-uint(i%8))&1]
+		if node == nil {
+			break
+		}
+		if node.set {
+			found, value = true, node.value
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("Key not found")
+	}
+	return value, nil
+}
+
+// Len returns the number of prefixes and exact keys in the map
+func (m *CIDRMap) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.n
+}
+
+func (m *CIDRMap) root(ip net.IP) *cidrNode {
+	if ip.To4() != nil {
+		return m.v4
+	}
+	return m.v6
+}
+
+// normalizeIP returns the 4 byte form of IPv4 addresses and the 16 byte form of the others
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// SetNetWhiteList sets the white list of client networks and addresses, consulted together with the white list when the
+// key of a message is an IP address, as picked by a KeyExtractor keying messages by client_address. IPv4 and IPv6
+// networks like 10.0.0.0/8 and 2001:db8::/32 whitelist every client in them. It may be called at any time to swap in
+// a reloaded list, nil removes it.
+func (rsw *RatelimitSlidingWindow) SetNetWhiteList(m *CIDRMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.networks = m
+	n := 0
+	if m != nil {
+		n = m.Len()
+	}
+	rsw.listLoaded(NetWhiteListName, n)
+}
+
+// checkNetwork reports whether k is an IP address on the network white list
+func (rsw *RatelimitSlidingWindow) checkNetwork(k string) bool {
+	if rsw.networks == nil || net.ParseIP(k) == nil {
+		return false
+	}
+	_, err := rsw.networks.Get(k)
+	return err == nil
+}
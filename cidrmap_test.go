@@ -0,0 +1,161 @@
+package postfix
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadCIDRReportsFirstInvalidLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "networks")
+	data := "10.0.0.0/8 ok\n# a comment\n10.1.0.0/33 bad\n192.168.1.0/24 ok\nexample/xx bad\n"
+	if err := ioutil.WriteFile(name, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		m, err := LoadCIDR(name)
+		if m != nil {
+			t.Fatal("LoadCIDR returned a map along with the error")
+		}
+		var me *MapError
+		if !errors.As(err, &me) || !errors.Is(err, ErrMalformedLine) {
+			t.Fatalf("LoadCIDR error = %v, want a *MapError wrapping ErrMalformedLine", err)
+		}
+		if me.File != name || me.Line != 3 {
+			t.Fatalf("error reported at %s:%d, want the first invalid line %s:3", me.File, me.Line, name)
+		}
+	}
+}
+
+func TestLoadCIDRMissingFile(t *testing.T) {
+	if _, err := LoadCIDR(filepath.Join(os.TempDir(), "postfix-missing-networks")); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("LoadCIDR error = %v, want ErrMapNotFound", err)
+	}
+}
+
+func TestCIDRMapLongestPrefix(t *testing.T) {
+	m := NewCIDRMap()
+	for k, v := range map[string]string{"10.0.0.0/8": "wide", "10.1.0.0/16": "narrow", "2001:db8::/32": "six", "10.1.2.3": "exact"} {
+		if err := m.Add(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct{ addr, want string }{
+		{"10.200.0.1", "wide"},
+		{"10.1.9.9", "narrow"},
+		{"10.1.2.3", "exact"},
+		{"2001:db8::1", "six"},
+	} {
+		if got, err := m.Get(c.addr); err != nil || got != c.want {
+			t.Errorf("Get(%s) = %q, %v, want %q", c.addr, got, err, c.want)
+		}
+	}
+	if _, err := m.Get("192.168.0.1"); err == nil {
+		t.Error("an address outside every network matched")
+	}
+	if got := m.Len(); got != 4 {
+		t.Errorf("Len = %d, want 4", got)
+	}
+}
+
+func TestNetWhiteListByClientAddress(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	nets := NewCIDRMap()
+	if err := nets.Add("192.0.2.0/24", ""); err != nil {
+		t.Fatal(err)
+	}
+	rsw.SetNetWhiteList(nets)
+	rsw.SetKeyExtractor(func(p *Policy) (string, int, bool) {
+		return p.Attribute("client_address"), 0, true
+	})
+
+	request := func(client, queueID string) string {
+		r := "request=smtpd_access_policy\nprotocol_state=RCPT\nsender=bob@example.com\nrecipient_count=1\n" +
+			"queue_id=" + queueID + "\nclient_address=" + client + "\n\n"
+		p, err := ParsePolicyRequest(bufio.NewReader(strings.NewReader(r)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rsw.RateLimitRequest(p)
+	}
+	for i := 0; i < 3; i++ {
+		if got := request("192.0.2.10", "A"+strings.Repeat("1", i+1)); got != "action=dunno\n\n" {
+			t.Fatalf("message %d from a whitelisted network = %q", i, got)
+		}
+	}
+	request("198.51.100.1", "B1")
+	if got := request("198.51.100.1", "B2"); got == "action=dunno\n\n" {
+		t.Error("a client outside the network white list was not limited")
+	}
+}
+
+func TestLoadCIDR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "networks")
+	if err := ioutil.WriteFile(name, []byte("# office\n10.0.0.0/8 OK # lan\n2001:db8::/32 OK\n192.0.2.7 OK\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadCIDR(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"10.9.8.7", "::ffff:10.1.1.1", "2001:db8:1::25", "192.0.2.7"} {
+		if v, err := m.Get(addr); err != nil || v != "OK" {
+			t.Errorf("Get(%s) = %q, %v, want OK", addr, v, err)
+		}
+	}
+	for _, addr := range []string{"11.0.0.1", "192.0.2.8", "2001:db9::1", "not an address"} {
+		if _, err := m.Get(addr); err == nil {
+			t.Errorf("Get(%s) matched", addr)
+		}
+	}
+}
+
+func TestCIDRMapAllAddresses(t *testing.T) {
+	m := NewCIDRMap()
+	if err := m.Add("0.0.0.0/0", "any"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Get("203.0.113.1"); err != nil || v != "any" {
+		t.Errorf("Get under 0.0.0.0/0 = %q, %v, want any", v, err)
+	}
+	if _, err := m.Get("2001:db8::1"); err == nil {
+		t.Error("an IPv6 address matched 0.0.0.0/0")
+	}
+}
+
+func TestSetNetWhiteListNil(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	nets := NewCIDRMap()
+	if err := nets.Add("192.0.2.0/24", ""); err != nil {
+		t.Fatal(err)
+	}
+	rsw.SetNetWhiteList(nets)
+	if !rsw.checkNetwork("192.0.2.1") {
+		t.Error("an address on the network white list did not match")
+	}
+	if rsw.checkNetwork("bob@example.com") {
+		t.Error("a sender matched the network white list")
+	}
+	rsw.SetNetWhiteList(nil)
+	if rsw.checkNetwork("192.0.2.1") {
+		t.Error("the removed network white list still matched")
+	}
+}
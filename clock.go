@@ -0,0 +1,63 @@
+package postfix
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells a RatelimitSlidingWindow the time, so tests can control it instead of waiting for the system clock
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the system, returning time.Now
+type SystemClock struct{}
+
+// Now returns the current time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockHolder wraps the Clock of a window, which is read without holding the window lock from an atomic.Value, and
+// that only holds values of a single concrete type
+type clockHolder struct {
+	c Clock
+}
+
+// SetClock makes the window read the time of its decisions from c, nil switches back to the system clock.
+// The window uses the system clock by default, following the monotonic clock when the wall clock is stepped.
+func (rsw *RatelimitSlidingWindow) SetClock(c Clock) {
+	rsw.clock.Store(clockHolder{c})
+}
+
+// ManualClock is a Clock that only moves when it is set or advanced, for testing window expiry without sleeping
+type ManualClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+// NewManualClock creates a ManualClock standing at t
+func NewManualClock(t time.Time) *ManualClock {
+	return &ManualClock{t: t}
+}
+
+// Now returns the time the clock stands at
+func (mc *ManualClock) Now() time.Time {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.t
+}
+
+// Set moves the clock to t
+func (mc *ManualClock) Set(t time.Time) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.t = t
+}
+
+// Advance moves the clock forward by d
+func (mc *ManualClock) Advance(d time.Duration) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.t = mc.t.Add(d)
+}
@@ -0,0 +1,135 @@
+package postfix
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWindowExpiryManualClock(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetClock(mc)
+	rsw.SetDefaultLimit(2)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d = %q, want it permitted", i, got)
+		}
+	}
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Fatal("message over the limit permitted")
+	}
+	mc.Advance(9 * time.Minute)
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Fatal("message permitted before the window expired")
+	}
+	mc.Advance(2 * time.Minute) // the slice of the messages ends a minute after them
+	if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+		t.Fatalf("message after the window expired = %q, want it permitted", got)
+	}
+}
+
+func TestDecayCountManualClock(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetClock(mc)
+	rsw.SetDecay(true)
+	if err := rsw.SetInterval("1h"); err != nil {
+		t.Fatal(err)
+	}
+	rsw.RateLimit("bob@example.com", 100)
+
+	tok := tokens.Token("bob@example.com")
+	if got := tok.Count(); got != 100 {
+		t.Errorf("decayed count right away = %d, want 100", got)
+	}
+	mc.Advance(time.Hour)
+	if got := tok.Count(); got != 37 {
+		t.Errorf("decayed count after one time constant = %d, want 37", got)
+	}
+}
+
+func TestReapManualClock(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetClock(mc)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	rsw.RateLimit("bob@example.com", 1)
+
+	if n := tokens.Reap(time.Hour); n != 0 {
+		t.Fatalf("reaped %d tokens still counting messages at the time of the window", n)
+	}
+	mc.Advance(2 * time.Hour)
+	if n := tokens.Reap(time.Hour); n != 1 {
+		t.Fatalf("reaped %d tokens idle for two hours of the window clock, want 1", n)
+	}
+}
+
+func TestSubMinuteSlicesManualClock(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetClock(mc)
+	rsw.SetDefaultLimit(2)
+	rsw.SetSliceDuration(10 * time.Second)
+	if err := rsw.SetInterval("30s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rsw.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	rsw.RateLimit("bob@example.com", 1) // in the slice of 12:00:00 to 12:00:10
+	mc.Advance(10 * time.Second)
+	rsw.RateLimit("bob@example.com", 1) // in the slice of 12:00:10 to 12:00:20
+	mc.Advance(29 * time.Second)
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Fatal("message permitted before the first slice left the 30s window")
+	}
+	mc.Advance(time.Second)
+	if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+		t.Fatalf("message once the first 10s slice left the window = %q, want it permitted", got)
+	}
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("message permitted while the second slice was still in the window")
+	}
+}
+
+func TestSetSliceDurationInvalid(t *testing.T) {
+	var logs bytes.Buffer
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetLogger(log.New(&logs, "", 0))
+	if err := rsw.SetInterval("30s"); err != nil {
+		t.Fatal(err)
+	}
+	rsw.SetSliceDuration(10 * time.Second)
+
+	for _, d := range []time.Duration{0, -time.Second, 1500 * time.Millisecond} {
+		logs.Reset()
+		rsw.SetSliceDuration(d)
+		if rsw.slice != 10*time.Second {
+			t.Errorf("SetSliceDuration(%s) changed the slice to %s", d, rsw.slice)
+		}
+		if !strings.Contains(logs.String(), "WARNING: ignoring slice duration") {
+			t.Errorf("SetSliceDuration(%s) logged %q, want a warning", d, logs.String())
+		}
+	}
+	logs.Reset()
+	rsw.SetSliceDuration(time.Minute)
+	if err := rsw.Validate(); !errors.Is(err, ErrInvalidInterval) {
+		t.Errorf("Validate with a slice longer than the interval = %v, want ErrInvalidInterval", err)
+	}
+	if !strings.Contains(logs.String(), "WARNING:") {
+		t.Errorf("a slice longer than the interval logged %q, want a warning", logs.String())
+	}
+}
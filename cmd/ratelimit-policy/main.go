@@ -0,0 +1,43 @@
+// Command ratelimit-policy is an example postfix policy daemon rate limiting senders with the postfix package
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kresike/postfix"
+)
+
+func main() {
+	var cfg postfix.Config
+	flag.StringVar(&cfg.Network, "network", "tcp", "network to listen on, tcp or unix")
+	flag.StringVar(&cfg.Address, "address", "127.0.0.1:10032", "address to listen on")
+	flag.StringVar(&cfg.WhiteList, "whitelist", "", "map file of whitelisted senders and domains")
+	flag.StringVar(&cfg.DomainList, "domains", "", "map file of per domain limits")
+	flag.IntVar(&cfg.DefaultLimit, "limit", 120, "messages allowed per interval for other senders")
+	flag.StringVar(&cfg.Interval, "interval", "1h", "window length, like 30m or 1h")
+	flag.StringVar(&cfg.DeferMessage, "message", "rate limit exceeded", "text sent to deferred senders")
+	flag.StringVar(&cfg.TokenFile, "tokens", "", "file to keep the rate limit state in across restarts")
+	flag.StringVar(&cfg.HealthAddr, "health", "", "address to serve the /healthz readiness endpoint on")
+	check := flag.Bool("check", false, "validate the settings and map files and exit, nonzero if any are invalid")
+	flag.Parse()
+
+	if *check {
+		errs := postfix.Validate(cfg)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("configuration ok")
+		return
+	}
+
+	cfg.Logger = log.New(os.Stderr, "ratelimit-policy: ", log.LstdFlags)
+	if err := postfix.Run(cfg); err != nil {
+		cfg.Logger.Fatalln(err)
+	}
+}
@@ -0,0 +1,75 @@
+package postfix
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// SetDecay switches the accounting of senders from time slices to an exponentially decaying count, so the count of a
+// sender falls gradually instead of in steps as slices expire. Every message adds to the count, which decays with the
+// interval as its time constant, so a sender steadily sending at its limit settles at about the limit.
+// The global limit is always accounted in time slices.
+func (rsw *RatelimitSlidingWindow) SetDecay(on bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.decay = on
+}
+
+// record records a permitted message in the token the way the window accounts senders
+func (rsw *RatelimitSlidingWindow) record(t *RatelimitToken, req *RatelimitRequest) {
+	if rsw.decay {
+		t.recordDecay(req.Time, req.Recipients, req.Interval)
+		return
+	}
+	t.record(req.Time, req.Recipients, rsw.sliceCap(req.Interval))
+}
+
+// recordDecay adds recipients to the decaying count of the token, tau is the time constant of the decay
+func (rlt *RatelimitToken) recordDecay(ts time.Time, recips int, tau time.Duration) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	if ts.After(rlt.lastSeen) {
+		rlt.lastSeen = ts
+	}
+	if rlt.clean.IsZero() {
+		rlt.clean = ts
+	}
+	if rlt.firstSeen.IsZero() || ts.Before(rlt.firstSeen) {
+		rlt.firstSeen = ts
+	}
+	atomic.StoreInt64(&rlt.tau, int64(tau))
+	v := rlt.decayed(ts) + float64(recips)
+	atomic.StoreUint64(&rlt.ewma, math.Float64bits(v))
+	if ts.UnixNano() > atomic.LoadInt64(&rlt.ewmaAt) {
+		atomic.StoreInt64(&rlt.ewmaAt, ts.UnixNano())
+	}
+	rlt.logger.Println("Recording message for", rlt.key, "decayed count:", v, "recipients:", recips)
+}
+
+// decayed returns the decaying count of the token at ts, it takes no lock
+func (rlt *RatelimitToken) decayed(ts time.Time) float64 {
+	tau := atomic.LoadInt64(&rlt.tau)
+	v := math.Float64frombits(atomic.LoadUint64(&rlt.ewma))
+	if tau <= 0 || v == 0 {
+		return v
+	}
+	dt := ts.UnixNano() - atomic.LoadInt64(&rlt.ewmaAt)
+	if dt <= 0 {
+		return v
+	}
+	return v * math.Exp(-float64(dt)/float64(tau))
+}
+
+// decayRetryAfter returns how long until the decaying count leaves room for need messages under limit,
+// the time constant if it never does
+func (rlt *RatelimitToken) decayRetryAfter(now time.Time, tau time.Duration, limit, need float64) time.Duration {
+	v := rlt.decayed(now)
+	if limit-need <= 0 {
+		return tau
+	}
+	if v+need <= limit {
+		return 0
+	}
+	return time.Duration(float64(tau) * math.Log(v/(limit-need)))
+}
@@ -0,0 +1,101 @@
+package postfix
+
+import (
+	"sync"
+	"time"
+)
+
+// decisionCache remembers recent responses by request identifier, so a message queried twice is recorded only once, even
+// if the queries arrive together
+type decisionCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*cachedDecision
+	swept   time.Time
+}
+
+// cachedDecision is a remembered response, a pending one is still being decided and done is closed once it is recorded
+type cachedDecision struct {
+	response string
+	expires  time.Time
+	pending  bool
+	done     chan struct{}
+}
+
+func newDecisionCache() *decisionCache {
+	var dc decisionCache
+	dc.entries = make(map[string]*cachedDecision)
+	return &dc
+}
+
+// requestID returns the identifier of the message a policy request is about or an empty string if it has none
+func requestID(req *Policy) string {
+	qid := req.Attribute("queue_id")
+	inst := req.Attribute("instance")
+	if qid == "" && inst == "" {
+		return ""
+	}
+	// requests in the RCPT stage share the queue id and instance, but each is about another recipient
+	return inst + "/" + qid + "/" + req.Attribute("recipient")
+}
+
+func (dc *decisionCache) setWindow(d time.Duration) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.window = d
+	if d <= 0 {
+		dc.entries = make(map[string]*cachedDecision)
+	}
+}
+
+// claim returns the remembered response to request k, waiting for it if the request is being decided. Otherwise it
+// returns a pending entry holding back repeated requests until the response is recorded with put, nil if k is not
+// remembered at all.
+func (dc *decisionCache) claim(k string, now time.Time) (string, bool, *cachedDecision) {
+	dc.mu.Lock()
+	if dc.window <= 0 || k == "" {
+		dc.mu.Unlock()
+		return "", false, nil
+	}
+	if e, ok := dc.entries[k]; ok && (e.pending || now.Before(e.expires)) {
+		dc.mu.Unlock()
+		<-e.done
+		if e.response == "" {
+			return dc.claim(k, now) // abandoned without a response, decide it again
+		}
+		return e.response, true, nil
+	}
+	if now.Sub(dc.swept) > dc.window {
+		for key, e := range dc.entries {
+			if !e.pending && !now.Before(e.expires) {
+				delete(dc.entries, key)
+			}
+		}
+		dc.swept = now
+	}
+	e := &cachedDecision{pending: true, done: make(chan struct{})}
+	dc.entries[k] = e
+	dc.mu.Unlock()
+	return "", false, e
+}
+
+// put records the response to request k of an entry returned by claim, releasing the repeated requests waiting for it.
+// Only the first response is recorded, an empty one abandons the entry.
+func (dc *decisionCache) put(k string, e *cachedDecision, response string, now time.Time) {
+	if e == nil {
+		return
+	}
+	dc.mu.Lock()
+	if !e.pending {
+		dc.mu.Unlock()
+		return
+	}
+	e.response = response
+	e.expires = now.Add(dc.window)
+	e.pending = false
+	if response == "" && dc.entries[k] == e {
+		delete(dc.entries, k)
+	}
+	dc.mu.Unlock()
+	close(e.done)
+}
@@ -0,0 +1,82 @@
+package postfix
+
+import (
+	"bufio"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRepeatedRequestsTogetherRecordedOnce(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(5)
+	rsw.SetDedupWindow(time.Minute)
+	var calls int32
+	rsw.SetKeyExtractor(func(p *Policy) (string, int, bool) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(50 * time.Millisecond) // lets the repeated requests arrive while the first is decided
+		}
+		return "", 0, false
+	})
+	request := func(queueID string) string {
+		r := "request=smtpd_access_policy\nprotocol_state=END-OF-MESSAGE\nsender=bob@example.com\n" +
+			"recipient_count=1\ninstance=1.2\nqueue_id=" + queueID + "\n\n"
+		p, err := ParsePolicyRequest(bufio.NewReader(strings.NewReader(r)))
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		return rsw.RateLimitRequest(p)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := request("ABC123"); got != "action=dunno\n\n" {
+				t.Errorf("repeated request = %q, want dunno", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("decided the repeated request %d times, want once", calls)
+	}
+	for i := 0; i < 4; i++ {
+		if got := request("Q" + string(rune('A'+i))); got != "action=dunno\n\n" {
+			t.Fatalf("message %d after the repeated one = %q, want it within the limit of 5", i+2, got)
+		}
+	}
+	if got := request("QZ"); got == "action=dunno\n\n" {
+		t.Error("sixth message permitted over the limit of 5")
+	}
+}
+
+func TestDecisionCacheAbandoned(t *testing.T) {
+	dc := newDecisionCache()
+	dc.setWindow(time.Minute)
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	_, _, e := dc.claim("k", now)
+	done := make(chan *cachedDecision)
+	go func() {
+		_, ok, again := dc.claim("k", now)
+		if ok {
+			t.Error("an abandoned request was answered from the cache")
+		}
+		done <- again
+	}()
+	dc.put("k", e, "", now)
+	again := <-done
+	if again == nil {
+		t.Fatal("the waiting request did not claim the abandoned one")
+	}
+	dc.put("k", again, "action=dunno\n\n", now)
+	dc.put("k", again, "action=reject\n\n", now)
+	if res, ok, _ := dc.claim("k", now); !ok || res != "action=dunno\n\n" {
+		t.Errorf("claim = %q, %v, want the first recorded response", res, ok)
+	}
+}
@@ -0,0 +1,41 @@
+package postfix
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errors returned by the package, wrapped with the details of the failure so callers can tell them apart with errors.Is
+var (
+	// ErrMapNotFound is returned when a map file does not exist
+	ErrMapNotFound = errors.New("map file not found")
+	// ErrMalformedLine is returned for a map file line that cannot be split into a key and a value, like one with an unterminated quote
+	ErrMalformedLine = errors.New("malformed line")
+	// ErrDuplicateKey is returned by LoadStrict for a key listed more than once
+	ErrDuplicateKey = errors.New("duplicate key")
+	// ErrInvalidLimit is returned for a limit that is not a message count, or an invalid interval following it
+	ErrInvalidLimit = errors.New("invalid limit")
+	// ErrInvalidInterval is returned for an interval the sliding window cannot account in whole slices
+	ErrInvalidInterval = errors.New("invalid interval")
+	// ErrMalformedRequest is returned for a policy request the policy delegation protocol does not allow
+	ErrMalformedRequest = errors.New("malformed policy request")
+)
+
+// MapError is an error loading a map file, along with the file and line number it occurred at
+type MapError struct {
+	File string
+	Line int // 0 when the error is not about a single line
+	Err  error
+}
+
+func (e *MapError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+	}
+	return e.File + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *MapError) Unwrap() error {
+	return e.Err
+}
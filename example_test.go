@@ -0,0 +1,40 @@
+package postfix_test
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kresike/postfix"
+)
+
+func ExampleFuncMatcher() {
+	// white list every sender of a domain ending in .example, without a map file
+	wl := postfix.NewMemoryMapMatcher(postfix.FuncMatcher(func(k string) (string, bool) {
+		return "", strings.HasSuffix(k, ".example")
+	}))
+	domains := postfix.NewMemoryMapFrom(map[string]string{"example.com": "2"})
+	rsw := postfix.NewRatelimitSlidingWindow(wl, domains, postfix.NewRatelimitTokenMap(1))
+
+	for i := 0; i < 3; i++ {
+		fmt.Print(rsw.RateLimit("bob@example.com", 1))
+	}
+	fmt.Print(rsw.RateLimit("alice@lists.example", 100))
+	// Output:
+	// action=dunno
+	//
+	// action=dunno
+	//
+	// action=defer_if_permit rate limit exceeded
+	//
+	// action=dunno
+}
+
+func ExampleNewMemoryMapFrom() {
+	wl := postfix.NewMemoryMapFrom(map[string]string{"trusted.com": ""})
+	rsw := postfix.NewRatelimitSlidingWindow(wl, postfix.NewMemoryMap(), postfix.NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	d := rsw.Decide("bob@trusted.com", 10)
+	fmt.Println(d.Permitted(), d.WhiteList.Form, d.WhiteList.Key)
+	// Output: true domain trusted.com
+}
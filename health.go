@@ -0,0 +1,44 @@
+package postfix
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// SetRequireLists makes Healthy fail while the white list or the domain list is missing or empty,
+// for deployments where an empty list means a failed load rather than a deliberately empty one
+func (rsw *RatelimitSlidingWindow) SetRequireLists(whiteList, domainList bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.needWhite = whiteList
+	rsw.needDomain = domainList
+}
+
+// Healthy returns an error if the RatelimitSlidingWindow is not fit to decide, a readiness check for orchestration.
+// It checks the required lists, the default limit and the interval. Tokens are kept in memory, there is no store to reach.
+func (rsw *RatelimitSlidingWindow) Healthy() error {
+	rsw.mu.RLock()
+	defer rsw.mu.RUnlock()
+	if rsw.needWhite && (rsw.whiteList == nil || rsw.whiteList.Len() == 0) {
+		return errors.New("white list is not loaded")
+	}
+	if rsw.needDomain && (rsw.domainList == nil || rsw.domainList.Len() == 0) {
+		return errors.New("domain list is not loaded")
+	}
+	if rsw.defaultLimit < 1 {
+		return fmt.Errorf("invalid default limit %d", rsw.defaultLimit)
+	}
+	return rsw.validate()
+}
+
+// HealthHandler returns an http.Handler answering 200 while the RatelimitSlidingWindow is healthy and 503 with the reason otherwise
+func (rsw *RatelimitSlidingWindow) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := rsw.Healthy(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
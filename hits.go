@@ -0,0 +1,75 @@
+package postfix
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// KeyHits is the number of decisions a single list entry took part in
+type KeyHits struct {
+	Key  string
+	Hits int64
+}
+
+// ListHits is the number of decisions the entries of a list took part in, along with its most used entries
+type ListHits struct {
+	List string
+	Hits int64
+	Top  []KeyHits
+}
+
+// hitCounter counts list hits per key with atomic increments, so counting never takes a lock once a key was seen
+type hitCounter struct {
+	total int64
+	keys  sync.Map // string to *int64
+}
+
+func (hc *hitCounter) hit(k string) {
+	atomic.AddInt64(&hc.total, 1)
+	v, ok := hc.keys.Load(k)
+	if !ok {
+		v, _ = hc.keys.LoadOrStore(k, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+func (hc *hitCounter) hits(name string, n int) ListHits {
+	res := ListHits{List: name, Hits: atomic.LoadInt64(&hc.total)}
+	hc.keys.Range(func(k, v interface{}) bool {
+		res.Top = append(res.Top, KeyHits{Key: k.(string), Hits: atomic.LoadInt64(v.(*int64))})
+		return true
+	})
+	sort.Slice(res.Top, func(i, j int) bool {
+		if res.Top[i].Hits != res.Top[j].Hits {
+			return res.Top[i].Hits > res.Top[j].Hits
+		}
+		return res.Top[i].Key < res.Top[j].Key
+	})
+	if n >= 0 && len(res.Top) > n {
+		res.Top = res.Top[:n]
+	}
+	return res
+}
+
+// listHits holds the hit counters of the lists used by a RatelimitSlidingWindow
+type listHits struct {
+	whiteList     hitCounter
+	autoWhiteList hitCounter
+	softWhiteList hitCounter
+	domainList    hitCounter
+	pairList      hitCounter
+	senderList    hitCounter
+}
+
+// ListHits returns how often each list took part in a decision along with its n most used entries, stale entries never show up
+func (rsw *RatelimitSlidingWindow) ListHits(n int) []ListHits {
+	return []ListHits{
+		rsw.hits.whiteList.hits("whitelist", n),
+		rsw.hits.autoWhiteList.hits("autowhitelist", n),
+		rsw.hits.softWhiteList.hits("softwhitelist", n),
+		rsw.hits.domainList.hits("domainlist", n),
+		rsw.hits.pairList.hits("pairlist", n),
+		rsw.hits.senderList.hits("senderlist", n),
+	}
+}
@@ -0,0 +1,61 @@
+package postfix
+
+import "math"
+
+// RatelimitLeakyBucket limits senders by a score every message adds its recipients to, which leaks away continuously at
+// a steady rate, deferring messages that would raise the score of their sender above the threshold. The score is only
+// brought up to date when the sender is seen, no timer runs per sender. It is the mirror image of a RatelimitTokenBucket,
+// the score being the tokens missing from a full bucket, and supports everything it does: SetCapacity is the threshold,
+// SetRate the leak rate, and a domain list entry like "50 10m" sets a threshold of 50 leaking away in 10 minutes.
+// Reap drops the senders whose score leaked away completely.
+type RatelimitLeakyBucket struct {
+	*RatelimitTokenBucket
+}
+
+// NewRatelimitLeakyBucket creates a structure of type RatelimitLeakyBucket, with a threshold of DefaultBucketCapacity
+// leaking away in an hour
+func NewRatelimitLeakyBucket(w, d *MemoryMap) *RatelimitLeakyBucket {
+	rlb := &RatelimitLeakyBucket{NewRatelimitTokenBucket(w, d)}
+	rlb.report = rlb.logScore
+	return rlb
+}
+
+// SetThreshold sets the score a sender may reach, the same as SetCapacity
+func (rlb *RatelimitLeakyBucket) SetThreshold(t int) error {
+	return rlb.SetCapacity(t)
+}
+
+// SetLeakRate sets how much of the score of a sender leaks away per second, the same as SetRate
+func (rlb *RatelimitLeakyBucket) SetLeakRate(perSecond float64) error {
+	return rlb.SetRate(perSecond)
+}
+
+// Score returns the score of the sender at the time of the clock, 0 for a sender not seen or reaped
+func (rlb *RatelimitLeakyBucket) Score(sender string) float64 {
+	rlb.rsw.mu.RLock()
+	defer rlb.rsw.mu.RUnlock()
+	sender = rlb.rsw.normalize(sender)
+	now := rlb.rsw.now()
+	_, capacity, rate, _ := rlb.limits(domainOf(sender))
+	rlb.bmu.Lock()
+	defer rlb.bmu.Unlock()
+	b, ok := rlb.buckets[sender]
+	if !ok {
+		return 0
+	}
+	return float64(capacity) - b.level(capacity, rate, now)
+}
+
+// logScore logs the outcome of a message with the score of its sender instead of the tokens left
+func (rlb *RatelimitLeakyBucket) logScore(sender string, recips int, left float64, capacity int, taken bool) {
+	if !taken {
+		rlb.rsw.logger.Println("Message from", sender, "deferred, score", score(left, capacity), "recipients", recips, "threshold", capacity)
+		return
+	}
+	rlb.rsw.logger.Println("Message accepted from", sender, "recipients", recips, "score", score(left, capacity), "threshold", capacity)
+}
+
+// score returns the score of a leaky bucket holding left tokens, rounded to hundredths for the log
+func score(left float64, capacity int) float64 {
+	return math.Round((float64(capacity)-left)*100) / 100
+}
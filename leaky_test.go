@@ -0,0 +1,59 @@
+package postfix
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucketScore(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rlb := NewRatelimitLeakyBucket(NewMemoryMap(), NewMemoryMap())
+	rlb.SetClock(mc)
+	if err := rlb.SetThreshold(10); err != nil {
+		t.Fatal(err)
+	}
+	if err := rlb.SetLeakRate(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := rlb.RateLimit("bob@example.com", 8); got != "action=dunno\n\n" {
+		t.Fatalf("first message = %q, want it permitted", got)
+	}
+	if got := rlb.Score("bob@example.com"); got != 8 {
+		t.Errorf("score = %v, want 8", got)
+	}
+	if got := rlb.RateLimit("bob@example.com", 3); got == "action=dunno\n\n" {
+		t.Fatal("message raising the score over the threshold permitted")
+	}
+	mc.Advance(time.Second)
+	if got := rlb.RateLimit("bob@example.com", 3); got != "action=dunno\n\n" {
+		t.Fatalf("message after a point leaked away = %q, want it permitted", got)
+	}
+	mc.Advance(time.Minute)
+	if got := rlb.Score("bob@example.com"); got != 0 {
+		t.Errorf("score after leaking away = %v, want 0", got)
+	}
+}
+
+func TestLeakyBucketLogsScore(t *testing.T) {
+	var buf bytes.Buffer
+	rlb := NewRatelimitLeakyBucket(NewMemoryMap(), NewMemoryMap())
+	rlb.SetClock(NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)))
+	rlb.SetLogger(log.New(&buf, "", 0))
+	rlb.RateLimit("bob@example.com", 5)
+
+	if !strings.Contains(buf.String(), "score 5 threshold 120") {
+		t.Errorf("log = %q, want the score of the sender", buf.String())
+	}
+
+	buf.Reset()
+	rtb := NewRatelimitTokenBucket(NewMemoryMap(), NewMemoryMap())
+	rtb.SetLogger(log.New(&buf, "", 0))
+	rtb.RateLimit("bob@example.com", 5)
+	if !strings.Contains(buf.String(), "tokens left 115") {
+		t.Errorf("log = %q, want the tokens left in the bucket", buf.String())
+	}
+}
@@ -0,0 +1,42 @@
+package postfix
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseLimit parses a message count, accepting k and m suffixes for thousands and millions like 1k or 2.5k.
+// A negative count gives an error wrapping ErrInvalidLimit, 0 is Unlimited.
+func ParseLimit(s string) (int, error) {
+	mult := 0.0
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult = 1e6
+	default:
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("malformed limit %q: %w", s, ErrInvalidLimit)
+		}
+		if v < 0 {
+			return 0, fmt.Errorf("limit %q is negative: %w", s, ErrInvalidLimit)
+		}
+		return v, nil
+	}
+	num := s[:len(s)-1]
+	if num == "" || strings.Trim(num, "0123456789.") != "" || strings.Count(num, ".") > 1 {
+		return 0, fmt.Errorf("malformed limit %q: %w", s, ErrInvalidLimit)
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed limit %q: %w", s, ErrInvalidLimit)
+	}
+	v := f * mult
+	if v != math.Trunc(v) || v > math.MaxInt32 {
+		return 0, fmt.Errorf("limit %q is not a valid message count: %w", s, ErrInvalidLimit)
+	}
+	return int(v), nil
+}
@@ -0,0 +1,32 @@
+package postfix
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"0", Unlimited},
+		{"120", 120},
+		{"1k", 1000},
+		{"2.5K", 2500},
+		{"3m", 3000000},
+	}
+	for _, tt := range tests {
+		if got, err := ParseLimit(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseLimitInvalid(t *testing.T) {
+	for _, in := range []string{"", "-1", "-1k", "lots", "1.5", "0.0001k", "1x", "k"} {
+		if _, err := ParseLimit(in); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("ParseLimit(%q) error = %v, want ErrInvalidLimit", in, err)
+		}
+	}
+}
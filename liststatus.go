@@ -0,0 +1,87 @@
+package postfix
+
+import (
+	"sort"
+	"time"
+)
+
+// names of the lists of a RatelimitSlidingWindow in ListStatus and ListReloadFailed
+const (
+	WhiteListName     = "whitelist"
+	SoftWhiteListName = "softwhitelist"
+	DomainListName    = "domainlist"
+	PairListName      = "pairlist"
+	SenderListName    = "senderlist"
+	NetWhiteListName  = "netwhitelist"
+)
+
+// ListStatus is the state of a list of a RatelimitSlidingWindow as of its last load
+type ListStatus struct {
+	List    string
+	Entries int
+	Loaded  time.Time // when the list in use was set
+	Failed  time.Time // when a reload last failed, zero if it never did or the list was set since
+	Error   string    // why that reload failed
+}
+
+// setList records a newly set list, it is called with the lock of the RatelimitSlidingWindow held
+func (rsw *RatelimitSlidingWindow) setList(name string, entries int) *ListStatus {
+	if rsw.lists == nil {
+		rsw.lists = make(map[string]*ListStatus)
+	}
+	st := &ListStatus{List: name, Entries: entries, Loaded: time.Now()}
+	rsw.lists[name] = st
+	return st
+}
+
+// mapEntries returns the number of entries of m, 0 for no map
+func mapEntries(m *MemoryMap) int {
+	if m == nil {
+		return 0
+	}
+	return m.Len()
+}
+
+// listLoaded records and logs a list set by one of the setters
+func (rsw *RatelimitSlidingWindow) listLoaded(name string, entries int) {
+	_, reloaded := rsw.lists[name]
+	st := rsw.setList(name, entries)
+	if reloaded {
+		rsw.logger.Println(name, "reloaded:", st.Entries, "entries")
+	} else {
+		rsw.logger.Println(name, "loaded:", st.Entries, "entries")
+	}
+}
+
+// ListReloadFailed records a failed reload of a list, so monitoring can tell the list in use is stale
+func (rsw *RatelimitSlidingWindow) ListReloadFailed(name string, err error) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if rsw.lists == nil {
+		rsw.lists = make(map[string]*ListStatus)
+	}
+	st, ok := rsw.lists[name]
+	if !ok {
+		st = &ListStatus{List: name}
+		rsw.lists[name] = st
+	}
+	st.Failed = time.Now()
+	st.Error = err.Error()
+	rsw.logger.Println(name, "reload failed, keeping the old one:", err.Error())
+}
+
+// Lists returns the status of every list set, in order of name
+func (rsw *RatelimitSlidingWindow) Lists() []ListStatus {
+	rsw.mu.RLock()
+	defer rsw.mu.RUnlock()
+	return rsw.listStatus()
+}
+
+func (rsw *RatelimitSlidingWindow) listStatus() []ListStatus {
+	res := make([]ListStatus, 0, len(rsw.lists))
+	for _, st := range rsw.lists {
+		res = append(res, *st)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].List < res[j].List })
+	return res
+}
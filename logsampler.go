@@ -0,0 +1,69 @@
+package postfix
+
+import (
+	"sync"
+	"time"
+)
+
+// logSampler limits the rejection log lines of a sender to one per period, the period is protected by the lock of the
+// RatelimitSlidingWindow and the senders by its own lock
+type logSampler struct {
+	mu      sync.Mutex
+	period  time.Duration
+	senders map[string]*sampledLog
+	swept   time.Time
+}
+
+type sampledLog struct {
+	logged     time.Time
+	suppressed int
+}
+
+func newLogSampler() *logSampler {
+	var ls logSampler
+	ls.senders = make(map[string]*sampledLog)
+	return &ls
+}
+
+// SetLogSampling logs the rejections of a sender at most once per period, noting how many were suppressed in between.
+// The first rejection of a sender is always logged, a period of 0 logs every rejection.
+func (rsw *RatelimitSlidingWindow) SetLogSampling(period time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.logSample.period = period
+	rsw.logSample.mu.Lock()
+	rsw.logSample.senders = make(map[string]*sampledLog)
+	rsw.logSample.mu.Unlock()
+}
+
+// logRejection logs a rejection line of a sender unless one was logged within the sampling period
+func (rsw *RatelimitSlidingWindow) logRejection(sender string, now time.Time, v ...interface{}) {
+	ls := rsw.logSample
+	if ls.period <= 0 {
+		rsw.logger.Println(v...)
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if now.Sub(ls.swept) > ls.period {
+		for k, sl := range ls.senders {
+			if now.Sub(sl.logged) > ls.period {
+				if sl.suppressed > 0 {
+					rsw.logger.Println("Suppressed", sl.suppressed, "rejection messages of", k)
+				}
+				delete(ls.senders, k)
+			}
+		}
+		ls.swept = now
+	}
+	sl, ok := ls.senders[sender]
+	if ok && now.Sub(sl.logged) < ls.period {
+		sl.suppressed++
+		return
+	}
+	if ok && sl.suppressed > 0 { // the sweep did not report them yet
+		v = append(v, "(suppressed", sl.suppressed, "similar messages)")
+	}
+	rsw.logger.Println(v...)
+	ls.senders[sender] = &sampledLog{logged: now}
+}
@@ -3,28 +3,323 @@ package postfix
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-// Load a map file into a memorymap
-func Load(filename string) *MemoryMap {
-	f, err := os.Open(filename)
+// Load a map file into a memorymap, a missing file gives an error wrapping ErrMapNotFound and a malformed line a *MapError.
+// Blank lines and lines starting with # are skipped, a # following whitespace starts a comment up to the end of the line
+// unless it is within a double quoted value, whose quotes are removed. Only a value starting with a double quote is quoted,
+// quotes anywhere else are ordinary characters, and such a value missing its closing quote gives a *MapError.
+func Load(filename string) (*MemoryMap, error) {
+	f, err := openMap(filename)
 	if err != nil {
-		fmt.Println("opening file: ", err.Error())
-		return nil
+		return nil, err
 	}
 	defer f.Close()
-	c := 0
-	s := bufio.NewScanner(f)
+	return LoadReader(f, filename)
+}
+
+// MustLoad loads a map file like Load, but panics if it fails
+func MustLoad(filename string) *MemoryMap {
+	res, err := Load(filename)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// ReloadFrom replaces the contents of the map with those of a map file loaded like Load, in a single step under the lock
+// of the map so lookups see either the old or the new contents. If loading fails the old contents are kept.
+func (m *MemoryMap) ReloadFrom(filename string) error {
+	res, err := Load(filename)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.v, m.notes, m.lower = res.v, res.notes, res.lower
+	return nil
+}
+
+// LoadRaw loads a map file like Load, but takes # and double quotes as ordinary characters, for maps whose keys contain them
+func LoadRaw(filename string) (*MemoryMap, error) {
+	f, err := openMap(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res, _, err := loadReader(f, filename, false)
+	return res, err
+}
+
+// LoadReader loads the lines of a map file from r into a memorymap, name is the file name reported in errors
+func LoadReader(r io.Reader, name string) (*MemoryMap, error) {
+	res, _, err := loadReader(r, name, true)
+	return res, err
+}
+
+// loadReader loads a map like LoadReader, also returning the line numbers of every key. Comments and quotes are only
+// recognized if comments is set.
+func loadReader(r io.Reader, name string, comments bool) (*MemoryMap, map[string][]int, error) {
 	res := NewMemoryMap()
+	lines := make(map[string][]int)
+	err := scanMap(r, name, comments, func(line int, k, v, note string) error {
+		lines[k] = append(lines[k], line)
+		res.AddWithNote(k, v, note)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, lines, nil
+}
+
+// scanMap calls add with every entry of a map file read from r in file order, along with its line number. An error of
+// add or a malformed line stops the scan with a *MapError for the line.
+func scanMap(r io.Reader, name string, comments bool, add func(line int, k, v, note string) error) error {
+	c := 0
+	s := bufio.NewScanner(r)
 	for s.Scan() {
 		c++
-		t := strings.Fields(s.Text())
-		if len(t) != 2 {
-			panic(fmt.Errorf("cannot parse file content of %s at line %d: %s", filename, c, t))
+		t, note, err := parseMapLine(s.Text(), comments)
+		if err != nil {
+			return &MapError{File: name, Line: c, Err: err}
+		}
+		if len(t) == 0 {
+			continue // blank line
+		}
+		if len(t) == 1 {
+			t = append(t, "") // a lone key, listed without a value
+		}
+		if err := add(c, t[0], t[1], note); err != nil {
+			return &MapError{File: name, Line: c, Err: err}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return &MapError{File: name, Err: err}
+	}
+	return nil
+}
+
+// LoadStrict loads a map file into a memorymap like Load, but returns an error instead of letting the last of
+// several entries of a key win, listing every duplicate key with its line numbers
+func LoadStrict(filename string) (*MemoryMap, error) {
+	f, err := openMap(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res, lines, err := loadReader(f, filename, true)
+	if err != nil {
+		return nil, err
+	}
+	var dups []string
+	for k, l := range lines {
+		if len(l) < 2 {
+			continue
+		}
+		nums := make([]string, len(l))
+		for i, n := range l {
+			nums[i] = strconv.Itoa(n)
+		}
+		dups = append(dups, k+" at lines "+strings.Join(nums, ", "))
+	}
+	if len(dups) > 0 {
+		sort.Strings(dups)
+		return nil, &MapError{File: filename, Err: fmt.Errorf("%w: %s", ErrDuplicateKey, strings.Join(dups, "; "))}
+	}
+	return res, nil
+}
+
+// Save writes the entries of the map as a map file Load reads back the same, a key value line for every entry sorted by key
+// with its note as a comment. Values Load would change, like ones with runs of whitespace or a #, are written within double
+// quotes. The map is only locked while the lines are formatted. It fails writing nothing for an entry Load cannot read back,
+// like a key with whitespace or a value with a line break, or with a double quote ahead of a #.
+func (m *MemoryMap) Save(w io.Writer) error {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.v))
+	for k := range m.v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		l, err := formatMapLine(k, m.v[k], m.notes[k])
+		if err != nil {
+			m.mu.RUnlock()
+			return err
+		}
+		lines[i] = l
+	}
+	m.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	for _, l := range lines {
+		if _, err := bw.WriteString(l + "\n"); err != nil {
+			return err
 		}
-		res.Add(t[0], t[1])
+	}
+	return bw.Flush()
+}
+
+// SaveFile writes the map to filename like Save, replacing the file only once it is complete and keeping its permissions
+func (m *MemoryMap) SaveFile(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := m.Save(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// formatMapLine formats an entry as a map file line, quoting the value if Load would not read it back as it is otherwise,
+// and checks that Load reads the line back as the entry
+func formatMapLine(k, v, note string) (string, error) {
+	line := k
+	if v != "" {
+		if v != strings.Join(strings.Fields(v), " ") || strings.Contains(v, "#") ||
+			v[0] == '"' {
+			line += " \"" + v + "\""
+		} else {
+			line += " " + v
+		}
+	}
+	if note = strings.TrimSpace(note); note != "" {
+		line += " # " + note
+	}
+	t, n, err := parseMapLine(line, true)
+	if len(t) == 1 {
+		t = append(t, "")
+	}
+	if err != nil || strings.ContainsAny(line, "\r\n") || len(t) != 2 || t[0] != k || t[1] != v || n != note {
+		return "", fmt.Errorf("%w: entry %q cannot be written so that it is read back", ErrMalformedLine, k)
+	}
+	return line, nil
+}
+
+// openMap opens a map file, a missing one gives an error wrapping ErrMapNotFound
+func openMap(filename string) (*os.File, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, &MapError{File: filename, Err: ErrMapNotFound}
+	}
+	if err != nil {
+		return nil, &MapError{File: filename, Err: err}
+	}
+	return f, nil
+}
+
+// parseMapLine splits a map file line into its key and value, along with the note of a trailing comment if comments are
+// recognized. A blank line gives no fields and a lone key a single one.
+func parseMapLine(line string, comments bool) ([]string, string, error) {
+	note := ""
+	if comments {
+		body, comment, err := splitComment(line)
+		if err != nil {
+			return nil, "", err
+		}
+		line, note = body, comment
+	}
+	t := strings.Fields(line)
+	if len(t) < 2 {
+		return t, note, nil
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), t[0]))
+	if comments && len(rest) >= 2 && rest[0] == '"' && rest[len(rest)-1] == '"' {
+		return []string{t[0], rest[1 : len(rest)-1]}, note, nil // a quoted value is kept as it is
+	}
+	return []string{t[0], strings.Join(t[1:], " ")}, note, nil // the remaining fields make up the value
+}
+
+// splitComment splits a line at the # starting its comment, a # at the start of the line or following whitespace that
+// is not within a quoted value, returning the text of the comment as well. Only a double quote starting the value opens
+// a quoted one, quotes anywhere else, in keys or within an unquoted value, are kept as they are.
+func splitComment(line string) (string, string, error) {
+	v := valueStart(line)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"' && i == v:
+			j := strings.IndexByte(line[i+1:], '"')
+			if j < 0 {
+				return "", "", fmt.Errorf("%w: unterminated quote in %q", ErrMalformedLine, line)
+			}
+			i += j + 1 // the closing quote
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i], strings.TrimSpace(line[i+1:]), nil
+		}
+	}
+	return line, "", nil
+}
+
+// valueStart returns the index of the first character of the value of a line, past its key and the whitespace around it
+func valueStart(line string) int {
+	i := 0
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+		i++
+	}
+	for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// LoadLimits loads a map file of message limits into a memorymap like Load, values may use the suffixes accepted by
+// ParseLimit and may be followed by the interval the limit applies to. An invalid limit gives a *MapError wrapping
+// ErrInvalidLimit for the first line it is on.
+func LoadLimits(filename string) (*MemoryMap, error) {
+	f, err := openMap(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res, lines, err := loadReader(f, filename, true)
+	if err != nil {
+		return nil, err
+	}
+	var bad *MapError
+	for k, v := range res.v {
+		if _, _, err := parseDomainLimit(v); err != nil {
+			l := lines[k]
+			if line := l[len(l)-1]; bad == nil || line < bad.Line {
+				bad = &MapError{File: filename, Line: line, Err: fmt.Errorf("limit of %s: %w", k, err)}
+			}
+		}
+	}
+	if bad != nil {
+		return nil, bad
+	}
+	return res, nil
+}
+
+// MustLoadLimits loads a map file of message limits like LoadLimits, but panics if it fails
+func MustLoadLimits(filename string) *MemoryMap {
+	res, err := LoadLimits(filename)
+	if err != nil {
+		panic(err)
 	}
 	return res
 }
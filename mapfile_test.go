@@ -0,0 +1,241 @@
+package postfix
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMissingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "missing")
+
+	if _, err := Load(name); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("Load error = %v, want ErrMapNotFound", err)
+	}
+	if _, err := LoadLimits(name); !errors.Is(err, ErrMapNotFound) {
+		t.Errorf("LoadLimits error = %v, want ErrMapNotFound", err)
+	}
+}
+
+func TestLoadLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(name, []byte("example.com 2.5k\nexample.org 50 10m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadLimits(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("example.org"); v != "50 10m" {
+		t.Errorf("example.org = %q, want %q", v, "50 10m")
+	}
+}
+
+func TestLoadLimitsInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "limits")
+	if err := ioutil.WriteFile(name, []byte("example.com 10\nexample.org lots\nexample.net 1x\nexample.org lots\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := LoadLimits(name)
+	if m != nil {
+		t.Error("LoadLimits returned a map along with the error")
+	}
+	var me *MapError
+	if !errors.As(err, &me) || !errors.Is(err, ErrInvalidLimit) {
+		t.Fatalf("LoadLimits error = %v, want a *MapError wrapping ErrInvalidLimit", err)
+	}
+	if me.Line != 3 {
+		t.Errorf("error reported at line %d, want the first invalid line 3", me.Line)
+	}
+}
+
+func TestMustLoadLimitsPanics(t *testing.T) {
+	defer func() {
+		if err, ok := recover().(error); !ok || !errors.Is(err, ErrMapNotFound) {
+			t.Errorf("MustLoadLimits panicked with %v, want ErrMapNotFound", err)
+		}
+	}()
+	MustLoadLimits(filepath.Join(os.TempDir(), "postfix-missing-limits"))
+}
+
+func TestLoadReaderQuotes(t *testing.T) {
+	data := `o"brien@example.com 10
+example.com say "hi # a note
+example.org "a # b" # quoted
+example.net "  spaced  "
+`
+	m, err := LoadReader(strings.NewReader(data), "quotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ k, v, note string }{
+		{`o"brien@example.com`, "10", ""},
+		{"example.com", `say "hi`, "a note"},
+		{"example.org", "a # b", "quoted"},
+		{"example.net", "  spaced  ", ""},
+	} {
+		if v, n, _ := m.GetWithNote(c.k); v != c.v || n != c.note {
+			t.Errorf("%s = %q with note %q, want %q with %q", c.k, v, n, c.v, c.note)
+		}
+	}
+}
+
+func TestLoadReaderUnterminatedQuote(t *testing.T) {
+	_, err := LoadReader(strings.NewReader("example.com 10\nexample.org \"open # note\n"), "quotes")
+	var me *MapError
+	if !errors.As(err, &me) || !errors.Is(err, ErrMalformedLine) || me.Line != 2 {
+		t.Errorf("LoadReader error = %v, want a *MapError wrapping ErrMalformedLine at line 2", err)
+	}
+}
+
+func TestSaveQuotedValues(t *testing.T) {
+	m := NewMemoryMapFrom(map[string]string{"a": `"starts`, "b": `ends"`, "c": "a  b", "d": `x "y" z`})
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadReader(&buf, "saved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		want, _ := m.Get(k)
+		if v, _ := got.Get(k); v != want {
+			t.Errorf("%s read back as %q, want %q", k, v, want)
+		}
+	}
+}
+
+func TestLoadReaderShortLines(t *testing.T) {
+	m, err := LoadReader(strings.NewReader("\n   \nbob@example.com\nexample.com 10\n\t\n"), "short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := m.Get("bob@example.com"); err != nil || v != "" {
+		t.Errorf("lone key = %q, %v, want it listed with an empty value", v, err)
+	}
+	if v, _ := m.Get("example.com"); v != "10" {
+		t.Errorf("example.com = %q, want %q", v, "10")
+	}
+	if n := m.Len(); n != 2 {
+		t.Errorf("loaded %d entries, want 2", n)
+	}
+}
+
+func TestSaveSorted(t *testing.T) {
+	m := NewMemoryMap()
+	m.AddWithNote("b@example.com", "10", "a note")
+	m.Add("a@example.com", "")
+	m.Add("c@example.com", "a # b")
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a@example.com\nb@example.com 10 # a note\nc@example.com \"a # b\"\n"; got != want {
+		t.Errorf("Save wrote %q, want %q", got, want)
+	}
+}
+
+func TestSaveFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "whitelist")
+	if err := ioutil.WriteFile(name, []byte("old 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMemoryMap()
+	m.AddWithNote("bob@example.com", "", "ticket 42")
+	m.Add("example.org", "50 10m")
+	if err := m.SaveFile(name); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("SaveFile changed the permissions to %s", fi.Mode().Perm())
+	}
+	got, err := Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != 2 {
+		t.Errorf("read back %d entries, want 2", got.Len())
+	}
+	if v, n, err := got.GetWithNote("bob@example.com"); err != nil || v != "" || n != "ticket 42" {
+		t.Errorf("bob@example.com read back as %q with note %q, %v", v, n, err)
+	}
+	if v, _ := got.Get("example.org"); v != "50 10m" {
+		t.Errorf("example.org read back as %q", v)
+	}
+
+	m.Add("bad key", "1")
+	if err := m.SaveFile(name); !errors.Is(err, ErrMalformedLine) {
+		t.Errorf("SaveFile of a key with whitespace = %v, want ErrMalformedLine", err)
+	}
+	if got, err := Load(name); err != nil || got.Len() != 2 {
+		t.Errorf("a failed SaveFile changed the file")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("SaveFile left %d files behind, want only the map", len(files))
+	}
+}
+
+func TestLoadRawKeepsComments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "raw")
+	if err := ioutil.WriteFile(name, []byte("example.com 10 # per hour\n#literal \"key\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := LoadRaw(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := raw.Get("example.com"); v != "10 # per hour" {
+		t.Errorf("LoadRaw value = %q, want the # kept", v)
+	}
+	if v, err := raw.Get("#literal"); err != nil || v != "\"key" {
+		t.Errorf("LoadRaw #literal = %q, %v, want the line kept as an entry", v, err)
+	}
+	m, err := Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("example.com"); v != "10" {
+		t.Errorf("Load value = %q, want the comment stripped", v)
+	}
+	if m.Len() != 1 {
+		t.Errorf("Load read %d entries, want the comment line skipped", m.Len())
+	}
+}
@@ -2,45 +2,242 @@ package postfix
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 )
 
-// MemoryMap is a lock protected map storing key value pairs
+// Matcher looks up the value of a key in a list, MemoryMap, CIDRMap and FuncMatcher implement it
+type Matcher interface {
+	Get(k string) (value string, err error)
+}
+
+// FuncMatcher is a Matcher backed by a function returning the value of a key and whether it is listed, handy for testing
+// the wiring of a policy without map files. Wrap it with NewMemoryMapMatcher to use it as a list.
+type FuncMatcher func(k string) (value string, ok bool)
+
+// Get returns the value of the key the function returns or error if it is not listed
+func (f FuncMatcher) Get(k string) (string, error) {
+	if v, ok := f(k); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("Key not found")
+}
+
+// MemoryMap is a lock protected map storing key value pairs, lookups only take a read lock so they never wait on each other
 type MemoryMap struct {
-	mu sync.Mutex
-	v  map[string]string
+	mu    sync.RWMutex
+	v     map[string]string
+	notes map[string]string
+	lower map[string]string // the keys folded to lower case, mapping to the key as written, for GetFold
+	match Matcher           // looked up for keys the map does not hold, see NewMemoryMapMatcher
 }
 
 // NewMemoryMap creates a new MemoryMap structure
 func NewMemoryMap() *MemoryMap {
 	var m MemoryMap
 	m.v = make(map[string]string)
+	m.notes = make(map[string]string)
+	m.lower = make(map[string]string)
 	return &m
 }
 
+// NewMemoryMapFrom creates a new MemoryMap holding a copy of the given key/value pairs, handy for building lists in code
+func NewMemoryMapFrom(v map[string]string) *MemoryMap {
+	m := NewMemoryMap()
+	for k, val := range v {
+		m.v[k] = val
+		m.index(k)
+	}
+	return m
+}
+
+// NewMemoryMapMatcher creates a new MemoryMap whose lookups fall back to m for the keys it does not hold, so a Matcher
+// like a FuncMatcher can stand in for a list anywhere a MemoryMap is taken. Such keys are looked up as they are, without
+// folding their case, and do not count in Len, Keys or Range.
+func NewMemoryMapMatcher(m Matcher) *MemoryMap {
+	res := NewMemoryMap()
+	res.match = m
+	return res
+}
+
 // Add adds a new key/value pair to the map
 func (m *MemoryMap) Add(k, v string) {
 	m.mu.Lock()
 	m.v[k] = v
+	m.index(k)
 	m.mu.Unlock()
 }
 
+// AddWithNote adds a new key/value pair to the map along with a note describing the entry
+func (m *MemoryMap) AddWithNote(k, v, note string) {
+	m.mu.Lock()
+	m.v[k] = v
+	m.index(k)
+	if note == "" {
+		delete(m.notes, k)
+	} else {
+		m.notes[k] = note
+	}
+	m.mu.Unlock()
+}
+
+// GetWithNote returns the value and the note stored under key in the map or error if not found
+func (m *MemoryMap) GetWithNote(k string) (value, note string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if value, ok := m.v[k]; ok {
+		return value, m.notes[k], nil
+	}
+	if value, ok := m.matched(k); ok {
+		return value, "", nil
+	}
+	return "", "", fmt.Errorf("Key not found")
+}
+
 // Get returns the value stored under key in the map or error if not found
 func (m *MemoryMap) Get(k string) (value string, err error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	value, ok := m.v[k]
-	if !ok {
-		return "", fmt.Errorf("Key not found")
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if value, ok := m.v[k]; ok {
+		return value, nil
+	}
+	if value, ok := m.matched(k); ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("Key not found")
+}
+
+// GetFold returns the key and value of the entry of k in the map, the entry of k itself or else one whose key only differs
+// from it in case, or error if not found. The key returned is the one of the entry as written.
+func (m *MemoryMap) GetFold(k string) (key, value string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if key, value, ok := m.fold(k); ok {
+		return key, value, nil
+	}
+	return "", "", fmt.Errorf("Key not found")
+}
+
+// GetWildcard returns the key and value of the entry of a domain, the domain itself or else the wildcard entry of its
+// closest parent domain, so mail.a.example.com matches *.a.example.com and then *.example.com, or error if not found.
+// A wildcard entry only matches subdomains, *.example.com does not match example.com. Domains match regardless of case
+// like GetFold.
+func (m *MemoryMap) GetWildcard(domain string) (key, value string, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if key, value, ok := m.fold(domain); ok {
+		return key, value, nil
+	}
+	for d := domain; ; {
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+		if key, value, ok := m.fold("*." + d); ok {
+			return key, value, nil
+		}
 	}
-	return value, nil
+	return "", "", fmt.Errorf("Key not found")
+}
+
+// fold returns the key and value of the entry of k or of one only differing from it in case, with mu held
+func (m *MemoryMap) fold(k string) (string, string, bool) {
+	if value, ok := m.v[k]; ok {
+		return k, value, true
+	}
+	if key, ok := m.lower[strings.ToLower(k)]; ok {
+		return key, m.v[key], true
+	}
+	if value, ok := m.matched(k); ok {
+		return k, value, true
+	}
+	return "", "", false
+}
+
+// matched returns the value of k from the Matcher the map falls back to, if it has one
+func (m *MemoryMap) matched(k string) (string, bool) {
+	if m.match == nil {
+		return "", false
+	}
+	value, err := m.match.Get(k)
+	return value, err == nil
+}
+
+// index adds k to the keys folded to lower case unless another key folding the same is there already, with mu held
+func (m *MemoryMap) index(k string) {
+	l := strings.ToLower(k)
+	if _, ok := m.lower[l]; !ok {
+		m.lower[l] = k
+	}
+}
+
+// unindex removes k from the keys folded to lower case, indexing another key folding the same instead, with mu held
+func (m *MemoryMap) unindex(k string) {
+	l := strings.ToLower(k)
+	if m.lower[l] != k {
+		return
+	}
+	delete(m.lower, l)
+	for o := range m.v {
+		if strings.ToLower(o) == l {
+			m.lower[l] = o
+			return
+		}
+	}
+}
+
+// GetInt returns the value stored under key parsed as an integer, values may use the suffixes accepted by ParseLimit
+func (m *MemoryMap) GetInt(k string) (int, error) {
+	v, err := m.Get(k)
+	if err != nil {
+		return 0, err
+	}
+	i, err := ParseLimit(v)
+	if err != nil {
+		return 0, fmt.Errorf("value of %s is not a number: %s", k, err)
+	}
+	return i, nil
 }
 
 // Remove removes a key from the map
 func (m *MemoryMap) Remove(k string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if _, ok := m.v[k]; !ok {
+		return
+	}
 	delete(m.v, k)
+	delete(m.notes, k)
+	m.unindex(k)
+}
+
+// Delete removes a key from the map, the same as Remove
+func (m *MemoryMap) Delete(k string) {
+	m.Remove(k)
+}
+
+// Keys returns the keys of the map in no particular order, a snapshot not reflecting later changes to the map
+func (m *MemoryMap) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.v))
+	for k := range m.v {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Range calls f with every key and value of the map in no particular order until f returns false. The map is read locked
+// meanwhile, so f must not change the map, it would deadlock.
+func (m *MemoryMap) Range(f func(k, v string) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for k, v := range m.v {
+		if !f(k, v) {
+			return
+		}
+	}
 }
 
 // Clear clears the entire map
@@ -48,4 +245,13 @@ func (m *MemoryMap) Clear() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.v = make(map[string]string)
+	m.notes = make(map[string]string)
+	m.lower = make(map[string]string)
+}
+
+// Len returns the number of entries in the map
+func (m *MemoryMap) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.v)
 }
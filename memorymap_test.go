@@ -0,0 +1,120 @@
+package postfix
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGetFold(t *testing.T) {
+	m := NewMemoryMap()
+	m.Add("Bob@Example.com", "1")
+	m.Add("bob@example.com", "2")
+
+	if k, v, err := m.GetFold("bob@example.com"); err != nil || k != "bob@example.com" || v != "2" {
+		t.Errorf("GetFold of the exact key = %q %q %v, want the exact entry", k, v, err)
+	}
+	m.Remove("bob@example.com")
+	if k, v, err := m.GetFold("BOB@EXAMPLE.COM"); err != nil || k != "Bob@Example.com" || v != "1" {
+		t.Errorf("GetFold after Remove = %q %q %v, want the entry differing in case", k, v, err)
+	}
+	m.Remove("Bob@Example.com")
+	if _, _, err := m.GetFold("bob@example.com"); err == nil {
+		t.Error("GetFold found a removed entry")
+	}
+}
+
+func TestGetWildcardFold(t *testing.T) {
+	m := NewMemoryMapFrom(map[string]string{"*.Example.COM": "10"})
+
+	if k, v, err := m.GetWildcard("mail.example.com"); err != nil || k != "*.Example.COM" || v != "10" {
+		t.Errorf("GetWildcard = %q %q %v, want the wildcard entry", k, v, err)
+	}
+	if _, _, err := m.GetWildcard("example.com"); err == nil {
+		t.Error("a wildcard entry matched its own domain")
+	}
+}
+
+func TestMemoryMapMatcher(t *testing.T) {
+	m := NewMemoryMapMatcher(FuncMatcher(func(k string) (string, bool) {
+		return "50", k == "*.example.com"
+	}))
+	m.Add("example.com", "10")
+
+	if v, err := m.Get("example.com"); err != nil || v != "10" {
+		t.Errorf("Get of an entry of the map = %q %v, want 10", v, err)
+	}
+	if k, v, err := m.GetWildcard("mail.example.com"); err != nil || k != "*.example.com" || v != "50" {
+		t.Errorf("GetWildcard = %q %q %v, want the entry of the matcher", k, v, err)
+	}
+	if _, err := m.Get("example.org"); err == nil {
+		t.Error("Get found a key neither the map nor the matcher has")
+	}
+	if m.Len() != 1 {
+		t.Errorf("Len = %d, want only the entries of the map", m.Len())
+	}
+}
+
+func TestGetWildcardClosestParent(t *testing.T) {
+	m := NewMemoryMapFrom(map[string]string{"*.example.com": "10", "*.a.example.com": "20", "b.a.example.com": "30"})
+
+	for _, c := range []struct{ domain, key, value string }{
+		{"mail.a.example.com", "*.a.example.com", "20"},
+		{"x.y.a.example.com", "*.a.example.com", "20"},
+		{"a.example.com", "*.example.com", "10"},
+		{"b.a.example.com", "b.a.example.com", "30"},
+		{"mail.example.com", "*.example.com", "10"},
+	} {
+		if k, v, err := m.GetWildcard(c.domain); err != nil || k != c.key || v != c.value {
+			t.Errorf("GetWildcard(%s) = %q %q %v, want %q %q", c.domain, k, v, err, c.key, c.value)
+		}
+	}
+	for _, d := range []string{"example.com", "example.org", "com", ""} {
+		if k, _, err := m.GetWildcard(d); err == nil {
+			t.Errorf("GetWildcard(%q) matched %q", d, k)
+		}
+	}
+}
+
+func TestMemoryMapIteration(t *testing.T) {
+	m := NewMemoryMapFrom(map[string]string{"a": "1", "b": "2", "c": "3"})
+
+	keys := m.Keys()
+	sort.Strings(keys)
+	if got := strings.Join(keys, ","); got != "a,b,c" {
+		t.Errorf("Keys = %s, want a,b,c", got)
+	}
+	m.Add("d", "4") // the keys returned before are a snapshot
+	if len(keys) != 3 {
+		t.Errorf("Keys changed with the map")
+	}
+	seen := map[string]string{}
+	m.Range(func(k, v string) bool {
+		seen[k] = v
+		return true
+	})
+	if len(seen) != 4 || seen["d"] != "4" {
+		t.Errorf("Range visited %v, want all 4 entries", seen)
+	}
+	n := 0
+	m.Range(func(k, v string) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Range went on after f returned false, %d calls", n)
+	}
+
+	m.Delete("a")
+	m.Delete("missing")
+	if _, err := m.Get("a"); err == nil {
+		t.Error("Get found a deleted entry")
+	}
+	if m.Len() != 3 {
+		t.Errorf("Len = %d, want 3", m.Len())
+	}
+	m.Clear()
+	if m.Len() != 0 || len(m.Keys()) != 0 {
+		t.Errorf("the map holds %d entries after Clear", m.Len())
+	}
+}
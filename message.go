@@ -0,0 +1,33 @@
+package postfix
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expandMessage replaces the placeholders of a message text with the values of the decision, leaving unknown ones literal:
+//
+//	{sender}       the sender of the message
+//	{count}        messages of the sender in the window before this one
+//	{limit}        the limit applying to the sender
+//	{remaining}    messages the sender may still send in the window, the limit less the count
+//	{retry}        how long until the message would fit, like 4m30s
+//	{retry_after}  the same in whole seconds rounded up, like 270
+func expandMessage(text string, d Decision) string {
+	if !strings.Contains(text, "{") {
+		return text
+	}
+	remaining := int64(d.Limit) - d.Count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return strings.NewReplacer(
+		"{sender}", d.Sender,
+		"{count}", strconv.FormatInt(d.Count, 10),
+		"{limit}", strconv.Itoa(d.Limit),
+		"{remaining}", strconv.FormatInt(remaining, 10),
+		"{retry}", d.RetryAfter.Round(time.Second).String(),
+		"{retry_after}", strconv.FormatInt(int64((d.RetryAfter+time.Second-1)/time.Second), 10),
+	).Replace(text)
+}
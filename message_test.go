@@ -0,0 +1,32 @@
+package postfix
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandMessage(t *testing.T) {
+	d := Decision{Sender: "bob@example.com", Count: 12, Limit: 10, RetryAfter: 269*time.Second + 200*time.Millisecond}
+	got := expandMessage("{sender} sent {count} of {limit}, {remaining} left, retry in {retry} or {retry_after}s {unknown}", d)
+	if want := "bob@example.com sent 12 of 10, 0 left, retry in 4m29s or 270s {unknown}"; got != want {
+		t.Errorf("expandMessage = %q, want %q", got, want)
+	}
+}
+
+func TestDeferMessageRemainingAndRetry(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetClock(mc)
+	rsw.SetDefaultLimit(3)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	rsw.SetDeferMessage("{remaining} left, retry after {retry_after}s")
+
+	rsw.RateLimit("bob@example.com", 2)
+	mc.Advance(4*time.Minute + 30*time.Second)
+	// the slice of the first message ends at 12:01, so it leaves the window at 12:11
+	if got, want := rsw.RateLimit("bob@example.com", 2), "action=defer_if_permit 1 left, retry after 390s\n\n"; got != want {
+		t.Errorf("RateLimit = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,313 @@
+package postfix
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// milter commands sent by the MTA and the responses sent back, as described in the libmilter protocol documentation
+const (
+	milterAbort   = 'A'
+	milterBody    = 'B'
+	milterConnect = 'C'
+	milterMacro   = 'D'
+	milterEOM     = 'E'
+	milterHelo    = 'H'
+	milterQuitNC  = 'K'
+	milterHeader  = 'L'
+	milterMail    = 'M'
+	milterEOH     = 'N'
+	milterOptNeg  = 'O'
+	milterQuit    = 'Q'
+	milterRcpt    = 'R'
+	milterData    = 'T'
+
+	milterContinue  = 'c'
+	milterReplyCode = 'y'
+)
+
+// milter protocol steps the MilterServer asks the MTA to leave out, everything but the envelope and DATA
+const milterSkipSteps = 0x01 | 0x02 | 0x10 | 0x20 | 0x40 | 0x100 // connect, helo, body, headers, end of headers, unknown
+
+// milterVersion is the highest milter protocol version spoken
+const milterVersion = 6
+
+var errMilterPacketTooLarge = errors.New("milter packet too large")
+
+// MilterServer enforces the limits of a RatelimitSlidingWindow over the milter protocol instead of policy delegation.
+// Messages are decided at the DATA command, once all recipients are known, or at the end of the message when the
+// MTA does not send the DATA command. Key extractors need a policy request and are not used.
+type MilterServer struct {
+	timeout  int64 // read timeout of a command in nanoseconds, 0 for none, atomic
+	mu       sync.Mutex
+	limiter  *RatelimitSlidingWindow
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	logger   *log.Logger
+}
+
+// NewMilterServer creates a structure of type MilterServer
+func NewMilterServer(rsw *RatelimitSlidingWindow) *MilterServer {
+	var ms MilterServer
+	ms.limiter = rsw
+	ms.conns = make(map[net.Conn]struct{})
+	ms.logger = orDiscard(nil)
+	return &ms
+}
+
+// SetLogger sets the logger on the MilterServer
+func (ms *MilterServer) SetLogger(l *log.Logger) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.logger = orDiscard(l)
+}
+
+// SetReadTimeout sets how long the server waits for the next command on a connection, including the time the MTA leaves it
+// idle between messages, before closing it. The default 0 waits forever.
+func (ms *MilterServer) SetReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&ms.timeout, int64(d))
+}
+
+// Serve accepts connections on l and handles them until Close is called
+func (ms *MilterServer) Serve(l net.Listener) error {
+	ms.mu.Lock()
+	if ms.closed {
+		ms.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	ms.listener = l
+	ms.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			ms.mu.Lock()
+			closed := ms.closed
+			ms.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if !ms.track(c) {
+			c.Close()
+			return nil
+		}
+		go ms.handle(c)
+	}
+}
+
+// Close stops accepting connections and closes the open ones
+func (ms *MilterServer) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.closed = true
+	var err error
+	if ms.listener != nil {
+		err = ms.listener.Close()
+	}
+	for c := range ms.conns {
+		c.Close()
+	}
+	return err
+}
+
+func (ms *MilterServer) track(c net.Conn) bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return false
+	}
+	ms.conns[c] = struct{}{}
+	return true
+}
+
+func (ms *MilterServer) untrack(c net.Conn) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.conns, c)
+}
+
+// milterMessage is the envelope of the message currently passing a milter connection
+type milterMessage struct {
+	sender  string
+	recips  int
+	queueID string
+	decided bool
+}
+
+// handle answers the commands of a connection, the MTA sends every message of an SMTP session over the same one
+func (ms *MilterServer) handle(c net.Conn) {
+	defer ms.untrack(c)
+	defer c.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			ms.logger.Println("ERROR: closing milter connection from", c.RemoteAddr(), "after a panic:", v)
+		}
+	}()
+
+	r := bufio.NewReader(c)
+	var msg milterMessage
+	for {
+		if t := atomic.LoadInt64(&ms.timeout); t > 0 {
+			c.SetReadDeadline(time.Now().Add(time.Duration(t)))
+		}
+		cmd, data, err := readMilterPacket(r)
+		if err != nil {
+			if err != io.EOF {
+				ms.logger.Println("Closing milter connection from", c.RemoteAddr(), "on error:", err.Error())
+			}
+			return
+		}
+		var reply []byte
+		switch cmd {
+		case milterOptNeg:
+			reply = milterNegotiate(data)
+		case milterMacro:
+			if v, ok := milterMacros(data)["i"]; ok {
+				msg.queueID = v
+			}
+		case milterMail:
+			msg = milterMessage{sender: milterAddress(data), queueID: msg.queueID}
+			reply = []byte{milterContinue}
+		case milterRcpt:
+			msg.recips++
+			reply = []byte{milterContinue}
+		case milterData:
+			reply = ms.decide(&msg)
+		case milterEOM:
+			reply = []byte{milterContinue}
+			if !msg.decided {
+				reply = ms.decide(&msg)
+			}
+			msg = milterMessage{}
+		case milterAbort, milterQuitNC:
+			msg = milterMessage{}
+		case milterQuit:
+			return
+		default: // connect, helo, headers and body if the MTA sends them anyway
+			reply = []byte{milterContinue}
+		}
+		if reply == nil {
+			continue
+		}
+		if err := writeMilterPacket(c, reply); err != nil {
+			ms.logger.Println("Failed to write milter response to", c.RemoteAddr(), err.Error())
+			return
+		}
+	}
+}
+
+// decide rate limits the message and returns the milter response of the decision
+func (ms *MilterServer) decide(msg *milterMessage) []byte {
+	msg.decided = true
+	d := ms.limiter.decide(&RatelimitRequest{Sender: msg.sender, Recipients: msg.recips, QueueID: msg.queueID})
+	ms.limiter.observe(d)
+	return milterReply(d)
+}
+
+// milterReply maps a decision to a milter response, continue for permitted messages and a reply code for the others
+func milterReply(d Decision) []byte {
+	if d.Permitted() {
+		return []byte{milterContinue}
+	}
+	code, status := "451", "4.7.1"
+	if d.Action.Name == "reject" {
+		code, status = "550", "5.7.1"
+	}
+	if d.Action.Status != "" {
+		status = d.Action.Status
+	}
+	text := strings.Replace(d.Action.Text, "%", "%%", -1) // the MTA formats the reply with it
+	return append([]byte{milterReplyCode}, code+" "+status+" "+text+"\x00"...)
+}
+
+// milterNegotiate answers the option negotiation of the MTA, asking it to skip the steps the limits do not need
+func milterNegotiate(data []byte) []byte {
+	version, protocol := uint32(milterVersion), uint32(0)
+	if len(data) >= 12 {
+		if v := binary.BigEndian.Uint32(data); v < version {
+			version = v
+		}
+		protocol = binary.BigEndian.Uint32(data[8:]) & milterSkipSteps
+	}
+	res := make([]byte, 13)
+	res[0] = milterOptNeg
+	binary.BigEndian.PutUint32(res[1:], version)
+	binary.BigEndian.PutUint32(res[5:], 0) // no message modifications
+	binary.BigEndian.PutUint32(res[9:], protocol)
+	return res
+}
+
+// milterMacros returns the macros defined by a macro command, a command code followed by name and value pairs
+func milterMacros(data []byte) map[string]string {
+	res := make(map[string]string)
+	if len(data) < 1 {
+		return res
+	}
+	args := milterStrings(data[1:])
+	for i := 0; i+1 < len(args); i += 2 {
+		res[strings.Trim(args[i], "{}")] = args[i+1]
+	}
+	return res
+}
+
+// milterAddress returns the address argument of a mail or rcpt command without its angle brackets
+func milterAddress(data []byte) string {
+	args := milterStrings(data)
+	if len(args) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(args[0], "<"), ">")
+}
+
+// milterStrings splits the NUL terminated strings of a command
+func milterStrings(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\x00")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\x00")
+}
+
+// readMilterPacket reads a packet of a 4 byte length, a command byte and the command data
+func readMilterPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n == 0 {
+		return 0, nil, errors.New("empty milter packet")
+	}
+	if n > DefaultMaxRequestSize {
+		return 0, nil, errMilterPacketTooLarge
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return buf[0], buf[1:], nil
+}
+
+// writeMilterPacket writes a response, its first byte is the response code
+func writeMilterPacket(w io.Writer, p []byte) error {
+	buf := make([]byte, 4+len(p))
+	binary.BigEndian.PutUint32(buf, uint32(len(p)))
+	copy(buf[4:], p)
+	_, err := w.Write(buf)
+	return err
+}
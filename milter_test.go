@@ -0,0 +1,204 @@
+package postfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMilterPacketFraming(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMilterPacket(&buf, []byte("Mbob@example.com\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes()[:4]; !bytes.Equal(got, []byte{0, 0, 0, 17}) {
+		t.Errorf("length header = %v, want 17", got)
+	}
+	cmd, data, err := readMilterPacket(&buf)
+	if err != nil || cmd != milterMail || string(data) != "bob@example.com\x00" {
+		t.Errorf("readMilterPacket = %q %q %v, want the packet written", cmd, data, err)
+	}
+	if _, _, err := readMilterPacket(&buf); err != io.EOF {
+		t.Errorf("readMilterPacket at the end = %v, want io.EOF", err)
+	}
+
+	if _, _, err := readMilterPacket(bytes.NewReader([]byte{0, 0, 0, 0})); err == nil {
+		t.Error("read an empty packet")
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], DefaultMaxRequestSize+1)
+	if _, _, err := readMilterPacket(bytes.NewReader(hdr[:])); err != errMilterPacketTooLarge {
+		t.Errorf("readMilterPacket of an oversized packet = %v, want errMilterPacketTooLarge", err)
+	}
+	if _, _, err := readMilterPacket(bytes.NewReader([]byte{0, 0, 0, 5, 'M', 'b'})); err != io.ErrUnexpectedEOF {
+		t.Errorf("readMilterPacket of a truncated packet = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMilterNegotiate(t *testing.T) {
+	offer := func(version, protocol uint32) []byte {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint32(b, version)
+		binary.BigEndian.PutUint32(b[4:], 0x1ff)
+		binary.BigEndian.PutUint32(b[8:], protocol)
+		return b
+	}
+	for _, c := range []struct {
+		data              []byte
+		version, protocol uint32
+	}{
+		{offer(2, 0xffffffff), 2, milterSkipSteps},
+		{offer(10, 0x3), milterVersion, 0x3},
+		{nil, milterVersion, 0},
+	} {
+		res := milterNegotiate(c.data)
+		if len(res) != 13 || res[0] != milterOptNeg {
+			t.Fatalf("milterNegotiate = %v, want an option negotiation", res)
+		}
+		if v := binary.BigEndian.Uint32(res[1:]); v != c.version {
+			t.Errorf("negotiated version %d, want %d", v, c.version)
+		}
+		if a := binary.BigEndian.Uint32(res[5:]); a != 0 {
+			t.Errorf("asked for actions %#x, want none", a)
+		}
+		if p := binary.BigEndian.Uint32(res[9:]); p != c.protocol {
+			t.Errorf("negotiated protocol %#x, want %#x", p, c.protocol)
+		}
+	}
+}
+
+func TestMilterMacros(t *testing.T) {
+	m := milterMacros([]byte("R{i}\x004XyZ1234\x00j\x00mail.example.com\x00{odd}\x00"))
+	if m["i"] != "4XyZ1234" || m["j"] != "mail.example.com" {
+		t.Errorf("milterMacros = %v, want i and j without braces", m)
+	}
+	if _, ok := m["odd"]; ok {
+		t.Error("a macro without a value was defined")
+	}
+	if len(milterMacros(nil)) != 0 {
+		t.Error("an empty macro command defined macros")
+	}
+	if got := milterAddress([]byte("<bob@example.com>\x00SIZE=100\x00")); got != "bob@example.com" {
+		t.Errorf("milterAddress = %q, want bob@example.com", got)
+	}
+}
+
+func TestMilterReply(t *testing.T) {
+	for _, c := range []struct {
+		a    Action
+		want string
+	}{
+		{Action{Name: "dunno"}, "c"},
+		{Action{Name: "defer_if_permit", Text: "50% over the limit"}, "y451 4.7.1 50%% over the limit\x00"},
+		{Action{Name: "defer", Status: "4.7.28", Text: "slow down"}, "y451 4.7.28 slow down\x00"},
+		{Action{Name: "reject", Text: "invalid recipient count"}, "y550 5.7.1 invalid recipient count\x00"},
+	} {
+		if got := string(milterReply(Decision{Action: c.a})); got != c.want {
+			t.Errorf("milterReply(%v) = %q, want %q", c.a, got, c.want)
+		}
+	}
+}
+
+func TestMilterSession(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(3)
+	ms := NewMilterServer(rsw)
+	client, server := net.Pipe()
+	defer client.Close()
+	go ms.handle(server)
+
+	send := func(p string) {
+		if err := writeMilterPacket(client, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reply := func() string {
+		cmd, data, err := readMilterPacket(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(cmd) + string(data)
+	}
+	opt := make([]byte, 12)
+	binary.BigEndian.PutUint32(opt, milterVersion)
+	send("O" + string(opt))
+	if got := reply(); got[0] != milterOptNeg {
+		t.Fatalf("option negotiation answered with %q", got)
+	}
+
+	message := func(recips int) string {
+		send("DM{i}\x00ABC123\x00") // macros get no reply
+		send("M<bob@example.com>\x00")
+		if got := reply(); got != "c" {
+			t.Fatalf("MAIL answered with %q", got)
+		}
+		for i := 0; i < recips; i++ {
+			send("R<alice" + string(rune('0'+i)) + "@example.org>\x00")
+			if got := reply(); got != "c" {
+				t.Fatalf("RCPT answered with %q", got)
+			}
+		}
+		send("T")
+		res := reply()
+		send("E")
+		if got := reply(); got != "c" {
+			t.Fatalf("end of message answered with %q", got)
+		}
+		return res
+	}
+	if got := message(2); got != "c" {
+		t.Errorf("DATA of 2 recipients under a limit of 3 answered with %q, want continue", got)
+	}
+	if got := message(2); !strings.HasPrefix(got, "y451 4.7.1 ") {
+		t.Errorf("DATA over the limit answered with %q, want a 451 reply", got)
+	}
+	send("Q")
+}
+
+func TestMilterRecoversPanic(t *testing.T) {
+	var logs syncBuffer
+	ms := NewMilterServer(nil) // deciding with no window panics
+	ms.SetLogger(log.New(&logs, "", 0))
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		ms.handle(server)
+		close(done)
+	}()
+
+	writeMilterPacket(client, []byte("M<bob@example.com>\x00"))
+	readMilterPacket(client)
+	writeMilterPacket(client, []byte("T"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection was not closed after the panic")
+	}
+	if !strings.Contains(logs.String(), "after a panic") {
+		t.Errorf("logged %q, want the panic", logs.String())
+	}
+}
+
+func TestMilterReadTimeout(t *testing.T) {
+	ms := NewMilterServer(NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1)))
+	ms.SetReadTimeout(50 * time.Millisecond)
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		ms.handle(server)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled connection was kept open past the read timeout")
+	}
+}
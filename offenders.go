@@ -0,0 +1,98 @@
+package postfix
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultOffenderPeriod is the default time over which the rejection score of an offender decays
+const DefaultOffenderPeriod = 24 * time.Hour
+
+// OffenderStat is the rejection score of a sender, the number of its messages deferred or rejected decayed over the offender period
+type OffenderStat struct {
+	Sender     string
+	Score      float64
+	Rejections int64 // every rejection since the sender became an offender, without decay
+	Last       time.Time
+}
+
+// offenders keeps the decaying rejection scores of senders, the period is protected by the lock of the
+// RatelimitSlidingWindow and the scores by its own lock
+type offenders struct {
+	mu      sync.Mutex
+	period  time.Duration
+	senders map[string]*OffenderStat
+	swept   time.Time
+}
+
+func newOffenders() *offenders {
+	var o offenders
+	o.period = DefaultOffenderPeriod
+	o.senders = make(map[string]*OffenderStat)
+	return &o
+}
+
+// decayed returns the score of of at the given time
+func (o *offenders) decayed(of *OffenderStat, now time.Time) float64 {
+	return of.Score * math.Exp(-float64(now.Sub(of.Last))/float64(o.period))
+}
+
+// reject adds a rejection to the score of the sender
+func (o *offenders) reject(sender string, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if now.Sub(o.swept) > o.period {
+		for k, of := range o.senders {
+			if o.decayed(of, now) < 0.01 {
+				delete(o.senders, k)
+			}
+		}
+		o.swept = now
+	}
+	of, ok := o.senders[sender]
+	if !ok {
+		of = &OffenderStat{Sender: sender}
+		o.senders[sender] = of
+	} else {
+		of.Score = o.decayed(of, now)
+	}
+	of.Score++
+	of.Rejections++
+	of.Last = now
+}
+
+// SetOffenderPeriod sets the time over which the rejection scores of TopOffenders decay, DefaultOffenderPeriod by default
+func (rsw *RatelimitSlidingWindow) SetOffenderPeriod(d time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if d > 0 {
+		rsw.offenders.period = d
+	}
+}
+
+// TopOffenders returns the n senders with the highest rejection scores
+func (rsw *RatelimitSlidingWindow) TopOffenders(n int) []OffenderStat {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	now := rsw.now()
+	rsw.offenders.mu.Lock()
+	defer rsw.offenders.mu.Unlock()
+	res := make([]OffenderStat, 0, len(rsw.offenders.senders))
+	for _, of := range rsw.offenders.senders {
+		st := *of
+		st.Score = rsw.offenders.decayed(of, now)
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].Sender < res[j].Sender
+	})
+	if n >= 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
@@ -1,6 +1,13 @@
 /*Package postfix is a data handler package for the Postfix mail server */
 package postfix
 
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
 /*Policy is the main data type for storing attributes of the postfix policy protocol */
 type Policy struct {
 	attributes map[string]string
@@ -43,3 +50,79 @@ func (pp Policy) String() string {
 	}
 	return res
 }
+
+/*ParseLimits bounds the memory a single policy request may take while it is parsed */
+type ParseLimits struct {
+	MaxLineLength int // longest name=value line accepted
+	MaxAttributes int // most attributes accepted in one request
+}
+
+/*DefaultParseLimits are generous limits for real postfix requests, which have a few dozen short attributes */
+var DefaultParseLimits = ParseLimits{MaxLineLength: 4096, MaxAttributes: 256}
+
+/*ParsePolicyRequest reads one policy request of name=value lines terminated by an empty line, io.EOF means no request was started */
+func ParsePolicyRequest(r *bufio.Reader) (*Policy, error) {
+	return ParsePolicyRequestLimits(r, DefaultParseLimits)
+}
+
+/*ParseRequest reads one policy request like ParsePolicyRequest, returning its attributes as a map of names to values */
+func ParseRequest(r *bufio.Reader) (map[string]string, error) {
+	p, err := ParsePolicyRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return p.attributes, nil
+}
+
+/*ParsePolicyRequestLimits reads one policy request like ParsePolicyRequest, failing on requests exceeding the given limits */
+func ParsePolicyRequestLimits(r *bufio.Reader, lim ParseLimits) (*Policy, error) {
+	p := NewPolicy()
+	empty := true
+	for {
+		line, err := readLine(r, lim.MaxLineLength)
+		if err != nil {
+			if err == io.EOF && empty && line == "" {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				return nil, fmt.Errorf("policy request not terminated by an empty line: %w", io.ErrUnexpectedEOF)
+			}
+			return nil, err
+		}
+		if line == "" {
+			return p, nil
+		}
+		empty = false
+		kv := strings.SplitN(line, "=", 2) // values may contain = themselves
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%w: line %q is not name=value", ErrMalformedRequest, line)
+		}
+		if _, ok := p.attributes[kv[0]]; !ok && len(p.attributes) >= lim.MaxAttributes {
+			return nil, fmt.Errorf("%w: more than %d attributes", ErrMalformedRequest, lim.MaxAttributes)
+		}
+		p.SetAttribute(kv[0], kv[1])
+	}
+}
+
+/*readLine reads a line without its line terminator, failing instead of buffering lines longer than max */
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > max+2 { // room for the \r\n terminator
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrMalformedRequest, max)
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		res := strings.TrimRight(string(line), "\r\n")
+		if len(res) > max {
+			return "", fmt.Errorf("%w: line longer than %d bytes", ErrMalformedRequest, max)
+		}
+		if err != nil {
+			return res, err
+		}
+		return res, nil
+	}
+}
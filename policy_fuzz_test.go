@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package postfix
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func FuzzParsePolicyRequest(f *testing.F) {
+	f.Add("request=smtpd_access_policy\nsender=bob@example.com\nrecipient_count=1\n\n")
+	f.Add("helo_name=a=b=c\n\n")
+	f.Add("no terminator\n")
+	f.Add("garbage\n\n")
+	f.Add("a=1\r\nb=2\r\n\r\n")
+	f.Add("\x00\xff=\x01\n\n")
+	f.Fuzz(func(t *testing.T, in string) {
+		r := bufio.NewReaderSize(strings.NewReader(in), 16)
+		lim := ParseLimits{MaxLineLength: 64, MaxAttributes: 8}
+		for i := 0; i <= len(in); i++ { // every request consumes a line at least, so this bounds a parser that hangs
+			p, err := ParsePolicyRequestLimits(r, lim)
+			if err != nil {
+				return
+			}
+			if n := len(p.Keys()); n > lim.MaxAttributes {
+				t.Fatalf("parsed %d attributes, more than the limit of %d", n, lim.MaxAttributes)
+			}
+			for _, k := range p.Keys() {
+				if len(k)+1+len(p.Attribute(k)) > lim.MaxLineLength {
+					t.Fatalf("attribute %q longer than the line limit", k)
+				}
+			}
+		}
+		t.Fatal("parser did not stop at the end of the input")
+	})
+}
@@ -0,0 +1,101 @@
+package postfix
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicyRequestValueWithEquals(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("request=smtpd_access_policy\nhelo_name=a=b=c\nccert_fingerprint=ab==\n\n"))
+	p, err := ParsePolicyRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Attribute("helo_name"); got != "a=b=c" {
+		t.Errorf("helo_name = %q, want %q", got, "a=b=c")
+	}
+	if got := p.Attribute("ccert_fingerprint"); got != "ab==" {
+		t.Errorf("ccert_fingerprint = %q, want %q", got, "ab==")
+	}
+}
+
+func TestParsePolicyRequestLineWithoutEquals(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("request=smtpd_access_policy\ngarbage\n\n"))
+	if _, err := ParsePolicyRequest(r); !errors.Is(err, ErrMalformedRequest) {
+		t.Errorf("ParsePolicyRequest error = %v, want ErrMalformedRequest", err)
+	}
+}
+
+func TestParsePolicyRequestLimits(t *testing.T) {
+	lim := ParseLimits{MaxLineLength: 32, MaxAttributes: 2}
+	for _, in := range []string{
+		"sender=" + strings.Repeat("x", 100) + "\n\n",
+		"a=1\nb=2\nc=3\n\n",
+	} {
+		if _, err := ParsePolicyRequestLimits(bufio.NewReader(strings.NewReader(in)), lim); !errors.Is(err, ErrMalformedRequest) {
+			t.Errorf("ParsePolicyRequestLimits(%.20q) error = %v, want ErrMalformedRequest", in, err)
+		}
+	}
+	if _, err := ParsePolicyRequestLimits(bufio.NewReader(strings.NewReader("a=1\na=2\n\n")), ParseLimits{MaxLineLength: 32, MaxAttributes: 1}); err != nil {
+		t.Errorf("a repeated attribute counted against the limit: %v", err)
+	}
+}
+
+func TestParsePolicyRequestUnterminated(t *testing.T) {
+	_, err := ParsePolicyRequest(bufio.NewReader(strings.NewReader("request=smtpd_access_policy\nsender=bob@example.com")))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ParsePolicyRequest error = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := ParsePolicyRequest(bufio.NewReader(strings.NewReader(""))); err != io.EOF {
+		t.Errorf("ParsePolicyRequest of no request = %v, want io.EOF", err)
+	}
+}
+
+func TestParseRequestSmtpd(t *testing.T) {
+	req := "request=smtpd_access_policy\nprotocol_state=RCPT\nprotocol_name=ESMTP\n" +
+		"client_address=192.0.2.10\nclient_name=mail.example.com\nhelo_name=mail.example.com\n" +
+		"sender=bob@example.com\nrecipient=alice@example.org\nrecipient_count=0\nqueue_id=\n" +
+		"instance=123.456.7\nsize=12345\nsasl_method=\nsasl_username=\nsasl_sender=\n\n"
+	second := "request=smtpd_access_policy\nprotocol_state=END-OF-MESSAGE\nsender=bob@example.com\n" +
+		"recipient=\nrecipient_count=2\nqueue_id=4XyZ1234\ninstance=123.456.7\nsasl_method=plain\nsasl_username=bob\n\n"
+	r := bufio.NewReader(strings.NewReader(req + second))
+
+	attrs, err := ParseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"request":        "smtpd_access_policy",
+		"protocol_state": "RCPT",
+		"client_address": "192.0.2.10",
+		"sender":         "bob@example.com",
+		"recipient":      "alice@example.org",
+		"instance":       "123.456.7",
+		"sasl_method":    "",
+		"sasl_username":  "",
+	} {
+		if got, ok := attrs[k]; !ok || got != want {
+			t.Errorf("%s = %q (present %v), want %q", k, got, ok, want)
+		}
+	}
+	if len(attrs) != 15 {
+		t.Errorf("parsed %d attributes, want 15", len(attrs))
+	}
+
+	attrs, err = ParseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs["protocol_state"] != "END-OF-MESSAGE" || attrs["recipient_count"] != "2" || attrs["sasl_username"] != "bob" {
+		t.Errorf("second pipelined request parsed as %v", attrs)
+	}
+	if _, ok := attrs["client_address"]; ok {
+		t.Error("an attribute of the first request leaked into the second")
+	}
+	if _, err := ParseRequest(r); err != io.EOF {
+		t.Errorf("ParseRequest after the last request = %v, want io.EOF", err)
+	}
+}
@@ -3,208 +3,1663 @@ package postfix
 import (
 	"bufio"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// sliceDuration is the default granularity of the time slices recorded in a RatelimitToken, see SetSliceDuration.
+// Messages are accounted in whole slices, so the interval should be a multiple of it
+// and never shorter, otherwise the window silently behaves as if it were one slice long.
+const sliceDuration = time.Minute
+
+// maxClockSkew is how far the wall clock may drift from the monotonic clock before a warning is logged
+const maxClockSkew = 5 * time.Second
+
 // RatelimitToken holds data for one sender about the amount of recently sent mails and is protected by a mutex
 type RatelimitToken struct {
+	count      int64 // count and sliceCount are written under mu but with atomic operations, so they can be read without it
+	sliceCount int64
+	ewma       uint64 // float64 bits of the decaying count, ewmaAt and tau are its time and time constant, all atomic
+	ewmaAt     int64
+	tau        int64
 	mu         sync.Mutex
+	busy       sync.Mutex // held by a decision from checking the count until recording the message, see RatelimitRequest.hold
 	key        string
-	tsd        map[time.Time]int
-	count      int
-	sliceCount int
+	tsd        map[int64]int // message counts by slice index, see index
+	slice      time.Duration // duration of the slices
+	override   int
+	overrideTo time.Time
+	lastSeen   time.Time
+	used       time.Time // when the map last handed the token out, protected by the mutex of its shard
+	clean      time.Time // when the sender was last deferred or first seen
+	firstSeen  time.Time // when the first message was recorded
+	seen       int       // messages permitted, for sampling
+	keep       int       // pruned slices kept in history for diagnostics, 0 keeps none
+	history    []SliceCount
+	clock      func() time.Time // the time of the map holding the token, see RatelimitTokenMap.now
 	logger     *log.Logger
 }
 
-// RatelimitTokenMap holds all the sender's tokens protected by a Mutex
+// SliceCount is the number of messages recorded in the time slice starting at Start
+type SliceCount struct {
+	Start time.Time
+	Count int
+}
+
+// Unlimited is the limit of a domain, sender or pair list entry permitting every message without counting it
+const Unlimited = 0
+
+// DefaultTokenHighWater is the default percentage of the token cap at which a warning is logged
+const DefaultTokenHighWater = 80
+
+// DefaultTokenShards is the number of shards of the token map used by Run
+const DefaultTokenShards = 32
+
+// RatelimitTokenMap holds all the sender's tokens, spread over shards locked separately so the tokens of different senders
+// are looked up concurrently. The mutex of the map protects its settings and is taken to add tokens, the lock of a shard is
+// never held while taking it.
 type RatelimitTokenMap struct {
+	n         int64 // number of tokens, atomic
+	mu        sync.Mutex
+	shards    []*tokenShard
+	max       int // most tokens kept, 0 means no cap
+	highWater int // percentage of max logging a warning
+	warned    bool
+	peak      int
+	evicted   int64
+	next      int // the shard the next eviction samples, taken in turn
+	keep      int // pruned slices new tokens keep in history
+	slice     time.Duration
+	horizon   time.Duration // longest interval of the windows using the map
+	clock     atomic.Value  // the now func of the window using the map, see setClock
+	logger    *log.Logger
+}
+
+// tokenShard holds the tokens of the keys hashing to it
+type tokenShard struct {
 	mu     sync.Mutex
 	tokens map[string]*RatelimitToken
-	logger *log.Logger
 }
 
-// RatelimitSlidingWindow is a data structure that holds all information necessary to make a decision whether to allow or block an email
+// RatelimitSlidingWindow is a data structure that holds all information necessary to make a decision whether to allow or block an email.
+// Decisions only read lock it, so messages of different senders are decided concurrently, serialized only by the token of their key
+// and by the global token while a global limit is set.
 type RatelimitSlidingWindow struct {
-	mu           sync.Mutex
+	mu           sync.RWMutex // write locked by the setters, read locked by the decisions
 	defaultLimit int
 	deferMessage string
+	deferStatus  string
+	limitAction  LimitAction
+	rejectLarge  bool
+	maxRecips    int
+	zeroRecips   ZeroRecipientMode
+	newLimit     int
+	newAge       time.Duration
+	attempts     bool
+	needWhite    bool
+	needDomain   bool
+	decay        bool
+	avgRate      float64 // messages per second, 0 compares the count to the limit
+	whiteListOK  bool
+	retryJitter  float64
+	localMode    LocalSenderMode
+	paused       bool
+	reasonTags   bool
+	subAddress   bool
+	foldCase     bool
+	stripSub     bool
+	wildcards    bool
+	terminator   string
+	globalLimit  int
+	globalMsg    string
+	globalBypass bool
+	maxSlices    int
+	slice        time.Duration
+	sampleRate   int
 	interval     time.Duration
 	whiteList    *MemoryMap
 	domainList   *MemoryMap
+	softList     *MemoryMap
+	pairList     *MemoryMap
+	senderList   *MemoryMap
+	networks     *CIDRMap
+	lists        map[string]*ListStatus
 	tokens       *RatelimitTokenMap
+	global       *RatelimitToken
+	chain        Chain
+	extractor    KeyExtractor
+	onDecision   func(Decision)
+	epoch        time.Time
+	skewed       int32 // 1 while the wall clock is off, set atomically as now runs under the read lock
+	decisions    *decisionCache
+	clock        atomic.Value
+	auto         *autoWhiteList
+	hits         *listHits
+	logSample    *logSampler
+	offenders    *offenders
+	counters     *Counters // updated atomically without holding mu
 	logger       *log.Logger
 }
 
+// Counters are the number of decisions made by a RatelimitSlidingWindow since the last reset
+type Counters struct {
+	Requests         int64 // messages decided, whatever the decision
+	Whitelisted      int64
+	PermittedDomain  int64 // permitted under a limit from the domain list
+	PermittedDefault int64 // permitted under the default limit
+	DeferredDomain   int64
+	DeferredDefault  int64
+	DeferredGlobal   int64 // deferred by the global limit regardless of the sender's own limit
+}
+
 // NewRatelimitSlidingWindow creates a structure of type RatelimitSlidingWindow
 func NewRatelimitSlidingWindow(w, d *MemoryMap, t *RatelimitTokenMap) *RatelimitSlidingWindow {
 	var rsw RatelimitSlidingWindow
 	rsw.defaultLimit = 120
 	rsw.deferMessage = "rate limit exceeded"
+	rsw.globalMsg = "global rate limit exceeded"
+	rsw.terminator = PolicyTerminator
 	rsw.whiteList = w
 	rsw.domainList = d
+	rsw.setList(WhiteListName, mapEntries(w))
+	rsw.setList(DomainListName, mapEntries(d))
 	rsw.tokens = t
+	rsw.tokens.setClock(rsw.now)
+	rsw.global = NewRatelimitToken("*")
+	rsw.global.clock = rsw.now
+	rsw.globalBypass = true
+	rsw.sampleRate = 1
+	rsw.foldCase = true
+	rsw.slice = sliceDuration
+	rsw.decisions = newDecisionCache()
+	rsw.auto = newAutoWhiteList()
+	rsw.hits = &listHits{}
+	rsw.logSample = newLogSampler()
+	rsw.offenders = newOffenders()
+	rsw.counters = &Counters{}
+	rsw.epoch = time.Now()
+	rsw.logger = orDiscard(nil)
+	rsw.setHorizon()
 
 	return &rsw
 }
 
-// NewRatelimitTokenMap creates a structure of type RatelimitTokenMap
-func NewRatelimitTokenMap() *RatelimitTokenMap {
-	var rt RatelimitTokenMap
-	rt.tokens = make(map[string]*RatelimitToken)
-	return &rt
+// NewRatelimitTokenMap creates a structure of type RatelimitTokenMap with its tokens spread over the given number of shards,
+// more shards let more senders seen for the first time be looked up at once, less than 1 means a single one
+func NewRatelimitTokenMap(shards int) *RatelimitTokenMap {
+	var rt RatelimitTokenMap
+	if shards < 1 {
+		shards = 1
+	}
+	rt.shards = make([]*tokenShard, shards)
+	for i := range rt.shards {
+		rt.shards[i] = &tokenShard{tokens: make(map[string]*RatelimitToken)}
+	}
+	rt.highWater = DefaultTokenHighWater
+	rt.slice = sliceDuration
+	rt.logger = orDiscard(nil)
+	return &rt
+}
+
+// SetMaxTokens caps the number of tokens kept, adding one more evicts one of the tokens used least recently, 0 means no cap
+func (rlm *RatelimitTokenMap) SetMaxTokens(n int) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.max = n
+	rlm.warned = false
+}
+
+// SetHighWater sets the percentage of the token cap at which a warning is logged, DefaultTokenHighWater by default
+func (rlm *RatelimitTokenMap) SetHighWater(percent int) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.highWater = percent
+	rlm.warned = false
+}
+
+// SetSliceHistory keeps the last n pruned slices of every token for diagnostics, they do not count toward any limit.
+// It is off by default, 0 turns it off again and drops the kept history.
+func (rlm *RatelimitTokenMap) SetSliceHistory(n int) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.keep = n
+	for _, t := range rlm.all() {
+		t.setHistory(n)
+	}
+}
+
+// setSlice changes the slice duration of all the tokens and of the ones added later
+func (rlm *RatelimitTokenMap) setSlice(d time.Duration) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.slice = d
+	for _, t := range rlm.all() {
+		t.setSlice(d)
+	}
+}
+
+// setHorizon raises the longest interval of the windows using the map to h
+func (rlm *RatelimitTokenMap) setHorizon(h time.Duration) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	if h > rlm.horizon {
+		rlm.horizon = h
+	}
+}
+
+// setClock makes the map and its tokens read the time from now, the time of the window using the map, so tokens are
+// reaped and decay by the same clock as the window decides by
+func (rlm *RatelimitTokenMap) setClock(now func() time.Time) {
+	rlm.clock.Store(now)
+}
+
+// now returns the time of the window using the map, the system time while no window uses it
+func (rlm *RatelimitTokenMap) now() time.Time {
+	if f, ok := rlm.clock.Load().(func() time.Time); ok {
+		return f()
+	}
+	return time.Now()
+}
+
+// History returns the pruned slices kept for the token of key, oldest first
+func (rlm *RatelimitTokenMap) History(key string) []SliceCount {
+	t, ok := rlm.lookup(key)
+	if !ok {
+		return nil
+	}
+	return t.History()
+}
+
+// shard returns the shard holding the token of k
+func (rlm *RatelimitTokenMap) shard(k string) *tokenShard {
+	if len(rlm.shards) == 1 {
+		return rlm.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return rlm.shards[h.Sum32()%uint32(len(rlm.shards))]
+}
+
+// all returns every token, locking one shard at a time
+func (rlm *RatelimitTokenMap) all() []*RatelimitToken {
+	res := make([]*RatelimitToken, 0, rlm.len())
+	for _, sh := range rlm.shards {
+		sh.mu.Lock()
+		for _, t := range sh.tokens {
+			res = append(res, t)
+		}
+		sh.mu.Unlock()
+	}
+	return res
+}
+
+// remove drops t from its shard unless another token replaced it already
+func (rlm *RatelimitTokenMap) remove(t *RatelimitToken) {
+	sh := rlm.shard(t.key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.tokens[t.key] == t {
+		delete(sh.tokens, t.key)
+		atomic.AddInt64(&rlm.n, -1)
+	}
+}
+
+// insert adds a token to the map, warning once the high water mark of the cap is crossed and evicting beyond the cap.
+// It is called with mu held.
+func (rlm *RatelimitTokenMap) insert(t *RatelimitToken) {
+	t.setSlice(rlm.slice)
+	if rlm.keep > 0 {
+		t.setHistory(rlm.keep)
+	}
+	t.clock = rlm.now
+	sh := rlm.shard(t.key)
+	sh.mu.Lock()
+	t.used = rlm.now()
+	_, replaced := sh.tokens[t.key]
+	sh.tokens[t.key] = t
+	sh.mu.Unlock()
+	if !replaced {
+		atomic.AddInt64(&rlm.n, 1)
+	}
+	n := rlm.len()
+	if n > rlm.peak {
+		rlm.peak = n
+	}
+	if rlm.max < 1 {
+		return
+	}
+	if n > rlm.max {
+		rlm.evict(t.key)
+	}
+	rlm.checkHighWater()
+}
+
+// checkHighWater logs a warning when the number of tokens reaches the high water mark, once until it drops below it again
+func (rlm *RatelimitTokenMap) checkHighWater() {
+	if rlm.max < 1 {
+		return
+	}
+	mark := rlm.max * rlm.highWater / 100
+	if rlm.len() < mark {
+		rlm.warned = false
+		return
+	}
+	if !rlm.warned {
+		rlm.logger.Println("WARNING: token map holds", rlm.len(), "tokens, reaching", rlm.highWater, "percent of its cap", rlm.max)
+		rlm.warned = true
+	}
+}
+
+// evictSamples is how many tokens an eviction looks at to pick the one used least recently
+const evictSamples = 16
+
+// evict drops the token used least recently of a sample of evictSamples tokens of a shard, except the one of key, so
+// eviction takes the same time however many tokens the map holds. The shards are sampled in turn and the order of
+// iterating a map is random, so the token dropped is close to the least recently used one of the whole map.
+// It is called with mu held.
+func (rlm *RatelimitTokenMap) evict(key string) {
+	for i := 0; i < len(rlm.shards); i++ {
+		sh := rlm.shards[rlm.next]
+		rlm.next = (rlm.next + 1) % len(rlm.shards)
+		sh.mu.Lock()
+		var oldest *RatelimitToken
+		n := 0
+		for k, t := range sh.tokens {
+			if k == key {
+				continue
+			}
+			if oldest == nil || t.used.Before(oldest.used) {
+				oldest = t
+			}
+			if n++; n == evictSamples {
+				break
+			}
+		}
+		if oldest == nil {
+			sh.mu.Unlock()
+			continue
+		}
+		used := oldest.used
+		delete(sh.tokens, oldest.key)
+		atomic.AddInt64(&rlm.n, -1)
+		sh.mu.Unlock()
+		rlm.evicted++
+		rlm.logger.Println("Token map full, evicted token of", oldest.key, "last used", used)
+		return
+	}
+}
+
+// TokenStats are the size and cap of a RatelimitTokenMap
+type TokenStats struct {
+	Tokens    int
+	Max       int
+	HighWater int // number of tokens at which a warning is logged, 0 without a cap
+	Peak      int // most tokens held at once
+	Evicted   int64
+}
+
+// Stats returns the size and cap of the token map
+func (rlm *RatelimitTokenMap) Stats() TokenStats {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	return TokenStats{
+		Tokens:    rlm.len(),
+		Max:       rlm.max,
+		HighWater: rlm.max * rlm.highWater / 100,
+		Peak:      rlm.peak,
+		Evicted:   rlm.evicted,
+	}
+}
+
+// NewRatelimitToken creates a structure of type RatelimitToken
+func NewRatelimitToken(k string) *RatelimitToken {
+	var t RatelimitToken
+	t.tsd = make(map[int64]int)
+	t.slice = sliceDuration
+	t.key = k
+	t.logger = orDiscard(nil)
+
+	return &t
+}
+
+// SetDefaultLimit sets the rate limit for domains not listed in the domain list and not whitelisted
+func (rsw *RatelimitSlidingWindow) SetDefaultLimit(l int) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.defaultLimit = l
+}
+
+// SetInterval sets the window interval that the limit applies to from a duration like 90s, 5m or 1h, an invalid or
+// non-positive one is an error that leaves the interval unchanged
+func (rsw *RatelimitSlidingWindow) SetInterval(i string) error {
+	d, err := parseInterval(i)
+	if err != nil {
+		return err
+	}
+	rsw.setInterval(d)
+	return nil
+}
+
+// SetIntervalSeconds sets the window interval that the limit applies to in seconds
+func (rsw *RatelimitSlidingWindow) SetIntervalSeconds(s int) error {
+	if s <= 0 {
+		return fmt.Errorf("%w: %d seconds, it must be positive", ErrInvalidInterval, s)
+	}
+	rsw.setInterval(time.Duration(s) * time.Second)
+	return nil
+}
+
+func (rsw *RatelimitSlidingWindow) setInterval(d time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.interval = d * -1
+	rsw.setHorizon()
+	if err := rsw.validate(); err != nil {
+		rsw.logger.Println("WARNING:", err)
+	}
+}
+
+// parseInterval parses a positive window interval
+func parseInterval(i string) (time.Duration, error) {
+	d, err := time.ParseDuration(i)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q is not a duration like 90s, 5m or 1h", ErrInvalidInterval, i)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%w: %s, it must be positive", ErrInvalidInterval, d)
+	}
+	return d, nil
+}
+
+// SetRate configures the default limit and the interval from a rate in messages per second and a burst, the number of messages
+// a sender may send at once. The window becomes burst/perSecond long, rounded up to whole slices, and the limit the number of
+// messages the rate allows in it. A burst shorter than a slice is thus raised to what the rate allows in one slice.
+func (rsw *RatelimitSlidingWindow) SetRate(perSecond float64, burst int) error {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if perSecond <= 0 || math.IsInf(perSecond, 0) || math.IsNaN(perSecond) {
+		return fmt.Errorf("invalid rate %v, it must be a positive number of messages per second", perSecond)
+	}
+	if burst < 1 {
+		return fmt.Errorf("invalid burst %d, it must be at least 1", burst)
+	}
+	window := time.Duration(float64(burst) / perSecond * float64(time.Second))
+	if window%rsw.slice != 0 || window == 0 {
+		window = (window/rsw.slice + 1) * rsw.slice
+	}
+	rsw.interval = window * -1
+	rsw.setHorizon()
+	rsw.defaultLimit = int(perSecond * window.Seconds())
+	rsw.logger.Println("Rate of", perSecond, "messages per second with a burst of", burst, "set as", rsw.defaultLimit, "messages per", window)
+	return nil
+}
+
+// SetMaxSlices caps the number of slices a token keeps, the oldest ones are dropped when exceeded. The default 0 derives the cap
+// from the interval and slice duration, so it only bites when slices outlive the window. Dropping slices undercounts the sender,
+// so a cap lower than the number of slices in the interval turns the limit into an approximation.
+func (rsw *RatelimitSlidingWindow) SetMaxSlices(n int) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.maxSlices = n
+}
+
+// SetSliceDuration sets the granularity senders are accounted in, one minute by default. Shorter slices follow the window
+// more closely, longer ones take less memory with long intervals. It must be a whole number of seconds, other durations are
+// ignored, and the interval should be a multiple of it, a warning is logged otherwise. The slices the tokens already hold are
+// merged into the new ones, keeping their counts, but shorter slices may expire those messages up to a slice early.
+// The slice duration is that of the token map, windows sharing one share it as well.
+func (rsw *RatelimitSlidingWindow) SetSliceDuration(d time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if d < time.Second || d%time.Second != 0 {
+		rsw.logger.Println("WARNING: ignoring slice duration", d, "it must be a whole number of seconds")
+		return
+	}
+	rsw.slice = d
+	rsw.tokens.setSlice(d)
+	rsw.global.setSlice(d)
+	if err := rsw.validate(); err != nil {
+		rsw.logger.Println("WARNING:", err)
+	}
+}
+
+func (rsw *RatelimitSlidingWindow) sliceCap(interval time.Duration) int {
+	if rsw.maxSlices > 0 {
+		return rsw.maxSlices
+	}
+	return int(interval/rsw.slice) + 1
+}
+
+// SetSampleRate makes the window record only one in every n permitted messages of a sender and multiply the recorded count by n
+// when comparing it to the limit. This is an approximation trading accuracy for less memory and locking on very busy senders,
+// the error grows with n and with the variance of the recipient counts. The default of 1 records every message.
+func (rsw *RatelimitSlidingWindow) SetSampleRate(n int) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	rsw.sampleRate = n
+}
+
+// Validate checks that the configuration of the RatelimitSlidingWindow is consistent
+func (rsw *RatelimitSlidingWindow) Validate() error {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	return rsw.validate()
+}
+
+func (rsw *RatelimitSlidingWindow) validate() error {
+	return validateInterval(rsw.interval*-1, rsw.slice)
+}
+
+// validateInterval checks that the window interval is made up of whole slices
+func validateInterval(interval, slice time.Duration) error {
+	if interval < slice {
+		return fmt.Errorf("%w: %s is shorter than the slice duration %s, it would be rounded up to one slice", ErrInvalidInterval, interval, slice)
+	}
+	if interval%slice != 0 {
+		return fmt.Errorf("%w: %s is not a multiple of the slice duration %s, it would be rounded to whole slices", ErrInvalidInterval, interval, slice)
+	}
+	return nil
+}
+
+// SetLogger sets the logger on the RatelimitSlidingWindow, nil discards the messages as before any logger is set
+func (rsw *RatelimitSlidingWindow) SetLogger(l *log.Logger) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.logger = orDiscard(l)
+	rsw.global.SetLogger(l)
+}
+
+// SetLogger sets the logger on the RatelimitTokenMap, nil discards the messages as before any logger is set
+func (rlm *RatelimitTokenMap) SetLogger(l *log.Logger) {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	rlm.logger = orDiscard(l)
+}
+
+// SetLogger sets the logger on the RatelimitToken, nil discards the messages as before any logger is set
+func (rlt *RatelimitToken) SetLogger(l *log.Logger) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	rlt.logger = orDiscard(l)
+}
+
+// orDiscard returns l, or a logger discarding the messages if l is nil
+func orDiscard(l *log.Logger) *log.Logger {
+	if l == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return l
+}
+
+// SetDeferMessage sets the defer message sent to the client in case the limit is exceeded, it may contain the placeholders
+// {sender}, {count}, {limit}, {remaining}, {retry} and {retry_after} like "limit of {limit} reached, retry in {retry}",
+// unknown placeholders are sent literally
+func (rsw *RatelimitSlidingWindow) SetDeferMessage(m string) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.deferMessage = m
+}
+
+// SetDeferStatus sets the enhanced status code sent ahead of the defer message, like 4.7.28 for a mail flood,
+// so rate limit defers can be told apart from those of other policies. It is empty by default.
+func (rsw *RatelimitSlidingWindow) SetDeferStatus(s string) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.deferStatus = s
+}
+
+// SetLimitAction sets the action returned when a limit is exceeded, DeferIfPermit by default
+func (rsw *RatelimitSlidingWindow) SetLimitAction(a LimitAction) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.limitAction = a
+}
+
+// SetMaxRecipients sets the highest recipient count accepted in a request, messages claiming more are rejected, 0 means no maximum
+func (rsw *RatelimitSlidingWindow) SetMaxRecipients(n int) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.maxRecips = n
+}
+
+// ZeroRecipientMode is the way a request with a recipient count of 0 is handled.
+// Postfix only knows the final recipient count in the DATA and END-OF-DATA stages, requests of the earlier
+// stages (CONNECT, HELO, MAIL FROM, RCPT TO, VRFY, ETRN) carry recipient_count=0, as do requests of other
+// integrations that leave it out.
+type ZeroRecipientMode int
+
+const (
+	// ZeroAsOne counts the message as having a single recipient
+	ZeroAsOne ZeroRecipientMode = iota
+	// ZeroAsZero checks the limit like for a single recipient without counting anything against it,
+	// so senders already at their limit are turned away before DATA
+	ZeroAsZero
+	// ZeroReject rejects the request as malformed
+	ZeroReject
+)
+
+// SetRetryJitter spreads the retry hints of deferred senders by up to the given percentage either way, so senders deferred
+// together do not all retry at once. The jitter of a sender stays the same within an interval.
+func (rsw *RatelimitSlidingWindow) SetRetryJitter(percent float64) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.retryJitter = percent
+}
+
+// jitter returns d spread by the retry jitter, derived from the key and the interval the request falls in
+func (rsw *RatelimitSlidingWindow) jitter(req *RatelimitRequest, d time.Duration) time.Duration {
+	if rsw.retryJitter <= 0 || d <= 0 || req.Interval <= 0 {
+		return d
+	}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s %d", req.Key, req.Time.UnixNano()/int64(req.Interval))
+	f := float64(h.Sum64()%2001)/1000 - 1 // -1 to 1
+	return time.Duration(float64(d) * (1 + f*rsw.retryJitter/100))
+}
+
+// SetNewSenderLimit sets the limit of senders whose first message was recorded less than age ago, replacing the limit that
+// would otherwise apply. Set it below the usual limits to curb snowshoe spam from fresh addresses, which is the usual use,
+// or above them to allow an initial burst. It is disabled by default, a limit of 0 disables it again.
+func (rsw *RatelimitSlidingWindow) SetNewSenderLimit(limit int, age time.Duration) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.newLimit = limit
+	rsw.newAge = age
+}
+
+// applyNewSender sets the new sender limit on the request if the token of its key is younger than the new sender age
+func (rsw *RatelimitSlidingWindow) applyNewSender(req *RatelimitRequest, t *RatelimitToken) {
+	if rsw.newLimit < 1 {
+		return
+	}
+	first := t.first()
+	if !first.IsZero() && req.Time.Sub(first) >= rsw.newAge {
+		return
+	}
+	req.Limit = rsw.newLimit
+	rsw.logger.Println("Limit of new sender", req.Sender, "set to", req.Limit, "first seen", first)
+}
+
+// SetCountAttempts makes messages deferred by their own limit count toward it, by default only permitted messages count.
+// Counting attempts keeps a sender hammering a closed limit shut out, but a sender retrying faster than its limit
+// allows then never gets through until it backs off, so a legitimate sender stuck in a retry loop stays deferred.
+func (rsw *RatelimitSlidingWindow) SetCountAttempts(c bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.attempts = c
+}
+
+// SetZeroRecipients sets the handling of requests with a recipient count of 0, ZeroAsOne by default
+func (rsw *RatelimitSlidingWindow) SetZeroRecipients(m ZeroRecipientMode) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.zeroRecips = m
+}
+
+// LocalSenderMode is the way senders without a domain, like root or a cron job of a local user, are handled.
+// The null sender of bounces is not a local sender, it is limited like any other.
+type LocalSenderMode int
+
+const (
+	// LocalByLocalPart limits every local sender under its own local part, the default.
+	// Local senders never match white list or domain list entries, an empty domain is not a key.
+	LocalByLocalPart LocalSenderMode = iota
+	// LocalExempt permits the messages of local senders without limiting them
+	LocalExempt
+)
+
+// SetLocalSenders sets the handling of senders without a domain, LocalByLocalPart by default
+func (rsw *RatelimitSlidingWindow) SetLocalSenders(m LocalSenderMode) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.localMode = m
+}
+
+// SetPaused pauses or resumes enforcement, while paused every message is permitted but still recorded,
+// so the counts are accurate once enforcement resumes
+func (rsw *RatelimitSlidingWindow) SetPaused(p bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	if p == rsw.paused {
+		return
+	}
+	rsw.paused = p
+	if p {
+		rsw.logger.Println("WARNING: rate limit enforcement PAUSED, all messages are permitted until resumed")
+	} else {
+		rsw.logger.Println("WARNING: rate limit enforcement RESUMED")
+	}
+}
+
+// SetRejectOversized makes RateLimit reject instead of defer messages whose recipients alone exceed the limit
+func (rsw *RatelimitSlidingWindow) SetRejectOversized(r bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.rejectLarge = r
+}
+
+// SetTerminator sets the string ending every response, postfix requires the default PolicyTerminator
+func (rsw *RatelimitSlidingWindow) SetTerminator(t string) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.terminator = t
+}
+
+// SetDedupWindow sets how long the response to a request is remembered by its queue_id and instance attributes,
+// so RateLimitRequest answers repeated queries about the same message without counting it again, 0 disables this
+func (rsw *RatelimitSlidingWindow) SetDedupWindow(d time.Duration) {
+	rsw.decisions.setWindow(d)
+}
+
+// SetReasonTags sets whether deferred and rejected responses carry a reason code tag like [rl-sender]
+func (rsw *RatelimitSlidingWindow) SetReasonTags(t bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.reasonTags = t
+}
+
+// SetMatchSubAddress sets whether a sender like user+tag@example.com also matches a user@example.com white list entry
+func (rsw *RatelimitSlidingWindow) SetMatchSubAddress(m bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.subAddress = m
+}
+
+// SetFoldCase sets whether sender addresses are folded to lower case before they are looked up in the lists and accounted,
+// so Bob@Example.com and bob@example.com share a limit. It is on by default, switch it off where local parts are case
+// sensitive. The domain is folded either way. List keys match senders regardless of case, so an entry written as
+// Bob@Example.com still matches, except for the local part keeping its case while folding is off.
+func (rsw *RatelimitSlidingWindow) SetFoldCase(f bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.foldCase = f
+}
+
+// SetStripSubAddress sets whether the +tag of a sender like bob+news@example.com is removed before the sender is looked up
+// in the lists and accounted, so every tag of an address shares its limit. It is off by default.
+func (rsw *RatelimitSlidingWindow) SetStripSubAddress(s bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.stripSub = s
+}
+
+// normalize returns the sender address in the form it is looked up and accounted under, with the transforms set by
+// SetFoldCase and SetStripSubAddress applied and the domain in lower case
+func (rsw *RatelimitSlidingWindow) normalize(sender string) string {
+	if rsw.stripSub {
+		sender = stripSubAddress(sender)
+	}
+	if rsw.foldCase {
+		return strings.ToLower(sender)
+	}
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		return sender[:at] + strings.ToLower(sender[at:])
+	}
+	return sender
+}
+
+// SetWildcardDomains sets whether a domain missing from the white list and the domain list matches a wildcard entry of
+// a parent domain, like *.example.com for mail.a.example.com, the closest parent taking precedence. Entries of the domain
+// itself always take precedence over wildcards. It is off by default, only matching domains exactly.
+func (rsw *RatelimitSlidingWindow) SetWildcardDomains(w bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.wildcards = w
+}
+
+// SetGlobalLimit sets the number of messages allowed per interval across all senders, 0 disables the global limit
+func (rsw *RatelimitSlidingWindow) SetGlobalLimit(l int) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.globalLimit = l
+}
+
+// SetGlobalDeferMessage sets the defer message sent when the global limit is exceeded, distinct from the per sender one,
+// it may contain the placeholders of SetDeferMessage
+func (rsw *RatelimitSlidingWindow) SetGlobalDeferMessage(m string) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.globalMsg = m
+}
+
+// SetGlobalBypassWhiteList sets whether whitelisted senders bypass the global limit in the default chain, they do by default
+func (rsw *RatelimitSlidingWindow) SetGlobalBypassWhiteList(b bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.globalBypass = b
+}
+
+// SetOverride grants a sender a limit that takes precedence over the domain and default limits until the given time,
+// Unlimited permits every message of the sender meanwhile
+func (rsw *RatelimitSlidingWindow) SetOverride(sender string, limit int, until time.Time) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	sender = rsw.normalize(sender)
+	rsw.tokens.Token(sender).SetOverride(limit, until)
+	rsw.logger.Println("Limit of", sender, "overridden to", limit, "until", until)
+}
+
+// SetWhiteListOK makes white list matches answer action=ok instead of dunno. Dunno leaves the decision to the restrictions
+// after the policy service, ok permits the message right away, so a white listed sender also bypasses every later restriction
+// of the same smtpd_*_restrictions list, like RBL or recipient checks. Use it only for fully trusted senders or after them.
+// The automatic white list and exempted local senders always get dunno.
+func (rsw *RatelimitSlidingWindow) SetWhiteListOK(ok bool) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.whiteListOK = ok
+}
+
+func (rsw *RatelimitSlidingWindow) whiteListAction() Action {
+	if rsw.whiteListOK {
+		return Action{Name: "ok"}
+	}
+	return Action{Name: "dunno"}
+}
+
+// SetWhiteList sets the white list, it may be called at any time to swap in a reloaded list.
+// Only the list is replaced, the in-window counts of the senders are kept.
+func (rsw *RatelimitSlidingWindow) SetWhiteList(wl *MemoryMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.whiteList = wl
+	rsw.listLoaded(WhiteListName, mapEntries(wl))
+}
+
+// SetSoftWhiteList sets the soft white list, whose entries raise the limit of a sender or domain instead of bypassing it.
+// A value like 3x multiplies the limit that would otherwise apply, a plain number like 5000 replaces it and Unlimited
+// permits every message.
+func (rsw *RatelimitSlidingWindow) SetSoftWhiteList(sl *MemoryMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.softList = sl
+	rsw.listLoaded(SoftWhiteListName, mapEntries(sl))
+}
+
+// SetDomainList sets the domain list, it may be called at any time to swap in a reloaded list.
+// Only the list is replaced, the in-window counts of the senders are kept and the new limits apply to them from the next message on.
+// A limit of Unlimited permits every message of the domain, an invalid one is logged and leaves the domain at the default limit.
+func (rsw *RatelimitSlidingWindow) SetDomainList(d *MemoryMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.domainList = d
+	rsw.listLoaded(DomainListName, mapEntries(d))
+	rsw.setHorizon()
+}
+
+// setHorizon tells the token map the longest interval the window counts messages in, the default one or one from the domain list
+func (rsw *RatelimitSlidingWindow) setHorizon() {
+	h := rsw.interval * -1
+	if rsw.domainList != nil {
+		rsw.domainList.mu.RLock()
+		for _, v := range rsw.domainList.v {
+			if _, d, err := parseDomainLimit(v); err == nil && d > h {
+				h = d
+			}
+		}
+		rsw.domainList.mu.RUnlock()
+	}
+	rsw.tokens.setHorizon(h)
+}
+
+// PairKey returns the key of a sender and recipient domain pair as used in the pair list, like user@us.com->gmail.com
+func PairKey(sender, recipientDomain string) string {
+	return sender + "->" + recipientDomain
+}
+
+// SetPairList sets the list of limits applying to messages of a sender to a recipient domain, keyed like user@us.com->gmail.com
+// with values like the domain list. Messages matching an entry are accounted under the pair instead of the sender alone,
+// Unlimited permits them all. It may be called at any time to swap in a reloaded list.
+func (rsw *RatelimitSlidingWindow) SetPairList(pl *MemoryMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.pairList = pl
+	rsw.listLoaded(PairListName, mapEntries(pl))
+}
+
+// SetSenderList sets the list of limits of individual senders, keyed by their full address, taking precedence over the limit of
+// their domain. The values are limits like those of the domain list, Unlimited permits every message of the sender.
+// Limits are looked up in the order: white list, pair list, sender list, domain list, and the default limit applies to the rest.
+func (rsw *RatelimitSlidingWindow) SetSenderList(sl *MemoryMap) {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+	rsw.senderList = sl
+	rsw.listLoaded(SenderListName, mapEntries(sl))
+}
+
+// checkSender sets the limit of the request from the sender list, reporting whether the sender is listed and whether it is
+// listed as unlimited
+func (rsw *RatelimitSlidingWindow) checkSender(req *RatelimitRequest) (listed, unlimited bool) {
+	k, v, ok := rsw.listEntry(rsw.senderList, req.Sender)
+	if !ok {
+		return false, false
+	}
+	limit, interval, err := parseDomainLimit(v)
+	if err != nil {
+		rsw.logger.Println("Failed to get sender limit for:", k, err.Error())
+		return false, false
+	}
+	rsw.hit(req, &rsw.hits.senderList, k)
+	if limit == Unlimited {
+		return true, true
+	}
+	req.Limit = limit
+	if interval > 0 {
+		req.Interval = interval
+	}
+	return true, false
+}
+
+// checkPair sets the key, limit and interval of the request if its sender and recipient domain have a pair list entry,
+// reporting whether the pair is listed and whether it is listed as unlimited
+func (rsw *RatelimitSlidingWindow) checkPair(req *RatelimitRequest) (listed, unlimited bool) {
+	if rsw.pairList == nil || req.Recipient == "" {
+		return false, false
+	}
+	i := strings.LastIndex(req.Recipient, "@")
+	if i < 0 {
+		return false, false
+	}
+	k, v, ok := rsw.listEntry(rsw.pairList, PairKey(req.Sender, strings.ToLower(req.Recipient[i+1:])))
+	if !ok {
+		return false, false
+	}
+	limit, interval, err := parseDomainLimit(v)
+	if err != nil {
+		rsw.logger.Println("Failed to get pair limit for:", k, err.Error())
+		return false, false
+	}
+	rsw.hit(req, &rsw.hits.pairList, k)
+	if limit == Unlimited {
+		return true, true
+	}
+	req.Key = k
+	req.Limit = limit
+	if interval > 0 {
+		req.Interval = interval
+	}
+	return true, false
+}
+
+// checkWhiteList returns the key of the white list entry of k and whether there is one, no white list and an empty key
+// match nothing
+func (rsw *RatelimitSlidingWindow) checkWhiteList(k string) (string, bool) {
+	if key, _, ok := rsw.listEntry(rsw.whiteList, k); ok {
+		return key, true
+	}
+	return k, rsw.checkNetwork(k)
+}
+
+// listEntry returns the key and value of the entry of a sender in m and whether there is one. Keys match regardless of
+// case, but while SetFoldCase is off only an entry with the local part of the sender as written matches.
+func (rsw *RatelimitSlidingWindow) listEntry(m *MemoryMap, k string) (string, string, bool) {
+	if m == nil || k == "" {
+		return "", "", false
+	}
+	key, v, err := m.GetFold(k)
+	if err != nil {
+		return "", "", false
+	}
+	if !rsw.foldCase && localPart(key) != localPart(k) {
+		return "", "", false
+	}
+	return key, v, true
+}
+
+// localPart returns the part of an address before its last @, the whole of it if it has none
+func localPart(addr string) string {
+	if at := strings.LastIndex(addr, "@"); at >= 0 {
+		return addr[:at]
+	}
+	return addr
+}
+
+// stripSubAddress removes the +tag part from the local part of an address
+func stripSubAddress(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		at = len(addr)
+	}
+	plus := strings.Index(addr[:at], "+")
+	if plus < 0 {
+		return addr
+	}
+	return addr[:plus] + addr[at:]
+}
+
+// whiteListNote returns the note of a white list entry formatted for log lines
+func (rsw *RatelimitSlidingWindow) whiteListNote(k string) string {
+	if rsw.whiteList == nil {
+		return ""
+	}
+	if _, note, err := rsw.whiteList.GetWithNote(k); err == nil && note != "" {
+		return "# " + note
+	}
+	return ""
+}
+
+// checkDomain returns the key of the domain list entry of k and whether there is one, no domain list leaves every sender
+// at the default limit
+func (rsw *RatelimitSlidingWindow) checkDomain(k string) (string, bool) {
+	return rsw.lookupDomain(rsw.domainList, k)
+}
+
+// lookupDomain returns the key of the entry of a domain in m and whether there is one, with SetWildcardDomains the key
+// may be a wildcard entry of a parent domain
+func (rsw *RatelimitSlidingWindow) lookupDomain(m *MemoryMap, dom string) (string, bool) {
+	if m == nil || dom == "" {
+		return "", false
+	}
+	if rsw.wildcards {
+		k, _, err := m.GetWildcard(dom)
+		return k, err == nil
+	}
+	k, _, err := m.GetFold(dom)
+	return k, err == nil
+}
+
+func (rsw *RatelimitSlidingWindow) checkGlobal(lim time.Time, recips int) bool {
+	if rsw.globalLimit < 1 {
+		return true
+	}
+	rsw.global.Prune(lim)
+	return rsw.global.count64()+int64(recips) <= int64(rsw.globalLimit)
+}
+
+// getDomainLimit returns the limit of a domain and the interval it applies to, 0 if the domain list does not set one.
+// It reports false if the domain is not listed or its limit is invalid, so the default limit applies.
+func (rsw *RatelimitSlidingWindow) getDomainLimit(dom string) (int, time.Duration, bool) {
+	if rsw.domainList == nil {
+		return 0, 0, false
+	}
+	d, err := rsw.domainList.Get(dom)
+	if err != nil {
+		rsw.logger.Println("Failed to get domain data for:", dom)
+		return 0, 0, false
+	}
+	val, interval, err := parseDomainLimit(d)
+	if err != nil {
+		rsw.logger.Println("WARNING: invalid limit for domain", dom, "applying the default limit:", err.Error())
+		return 0, 0, false
+	}
+	return val, interval, true
+}
+
+// parseDomainLimit parses a domain list value made of a limit and an optional interval like "50 10m"
+func parseDomainLimit(v string) (int, time.Duration, error) {
+	f := strings.Fields(v)
+	if len(f) < 1 || len(f) > 2 {
+		return 0, 0, fmt.Errorf("malformed domain limit %q: %w", v, ErrInvalidLimit)
+	}
+	val, err := ParseLimit(f[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(f) == 1 {
+		return val, 0, nil
+	}
+	interval, err := time.ParseDuration(f[1])
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("malformed interval %q in domain limit: %w", f[1], ErrInvalidLimit)
+	}
+	return val, interval, nil
+}
+
+func (rsw *RatelimitSlidingWindow) deferAction(reason string) Action {
+	return Action{Name: rsw.limitAction.String(), Status: rsw.deferStatus, Text: rsw.deferMessage, Reason: reason}
 }
 
-// NewRatelimitToken creates a structure of type RatelimitToken
-func NewRatelimitToken(k string) *RatelimitToken {
-	var t RatelimitToken
-	t.tsd = make(map[time.Time]int)
-	t.key = k
-	t.count = 0
-	t.sliceCount = 0
+func (rsw *RatelimitSlidingWindow) response(a Action) string {
+	if rsw.reasonTags {
+		a = a.tagged()
+	}
+	return a.Format(rsw.terminator)
+}
 
-	return &t
+// now returns the time of the Clock set by SetClock, or the wall clock time at creation advanced by the monotonic clock,
+// so when NTP steps the wall clock slices are neither expired all at once nor kept beyond their time
+func (rsw *RatelimitSlidingWindow) now() time.Time {
+	if h, ok := rsw.clock.Load().(clockHolder); ok && h.c != nil {
+		return h.c.Now()
+	}
+	wall := time.Now()
+	t := rsw.epoch.Add(wall.Sub(rsw.epoch)).Round(0)
+	skew := wall.Round(0).Sub(t)
+	if skew < -maxClockSkew || skew > maxClockSkew {
+		if atomic.CompareAndSwapInt32(&rsw.skewed, 0, 1) {
+			rsw.logger.Println("WARNING: wall clock differs by", skew, "from the monotonic clock, keeping monotonic time")
+		}
+	} else {
+		atomic.StoreInt32(&rsw.skewed, 0)
+	}
+	return t
 }
 
-// SetDefaultLimit sets the rate limit for domains not listed in the domain list and not whitelisted
-func (rsw *RatelimitSlidingWindow) SetDefaultLimit(l int) {
+// KeyExtractor returns the key a policy request is accounted under and optionally its limit, 0 meaning the usual limits apply.
+// Returning false falls back to accounting the request under its sender.
+type KeyExtractor func(p *Policy) (key string, limit int, ok bool)
+
+// SetKeyExtractor sets the function RateLimitRequest uses to pick the key a request is accounted under, nil restores keying by sender
+func (rsw *RatelimitSlidingWindow) SetKeyExtractor(f KeyExtractor) {
 	rsw.mu.Lock()
 	defer rsw.mu.Unlock()
-	rsw.defaultLimit = l
+	rsw.extractor = f
 }
 
-// SetInterval sets the window interval that the limit applies to
-func (rsw *RatelimitSlidingWindow) SetInterval(i string) {
+// SetChain sets the policy chain evaluated by RateLimit, a nil chain restores the default one
+// The chain is evaluated with the RatelimitSlidingWindow locked, so its rules must not call its methods
+func (rsw *RatelimitSlidingWindow) SetChain(c Chain) {
 	rsw.mu.Lock()
 	defer rsw.mu.Unlock()
-	d, err := time.ParseDuration(i + "s")
-	if err != nil {
-		rsw.logger.Println("Failed to parse duration", i)
-	}
-	rsw.interval = d * -1
+	rsw.chain = c
 }
 
-// SetLogger sets the logger on the RatelimitSlidingWindow
-func (rsw *RatelimitSlidingWindow) SetLogger(l *log.Logger) {
+// DefaultChain returns the chain of built in policies used when no chain is set
+func (rsw *RatelimitSlidingWindow) DefaultChain() Chain {
 	rsw.mu.Lock()
 	defer rsw.mu.Unlock()
-	rsw.logger = l
+	return rsw.defaultChain()
 }
 
-// SetLogger sets the logger on the RatelimitTokenMap
-func (rlm *RatelimitTokenMap) SetLogger(l *log.Logger) {
-	rlm.mu.Lock()
-	defer rlm.mu.Unlock()
-	rlm.logger = l
+func (rsw *RatelimitSlidingWindow) defaultChain() Chain {
+	if rsw.globalBypass {
+		return Chain{rsw.WhiteListPolicy(), rsw.LimitPolicy(), rsw.GlobalPolicy(), rsw.SenderPolicy()}
+	}
+	return Chain{rsw.GlobalPolicy(), rsw.WhiteListPolicy(), rsw.LimitPolicy(), rsw.SenderPolicy()}
 }
 
-// SetLogger sets the logger on the RatelimitToken
-func (rlt *RatelimitToken) SetLogger(l *log.Logger) {
-	rlt.mu.Lock()
-	defer rlt.mu.Unlock()
-	rlt.logger = l
+// WhiteListPolicy returns the policy permitting senders whose address or domain is on the white list
+func (rsw *RatelimitSlidingWindow) WhiteListPolicy() PolicyRule {
+	return PolicyFunc(func(req *RatelimitRequest) (Action, bool) {
+		if rsw.localMode == LocalExempt && req.Sender != "" && req.Domain == "" {
+			rsw.logger.Println("Allowing local sender:", req.Sender, req.ref())
+			rsw.whiteListed(req)
+			req.match = ListMatch{Form: MatchLocal, Key: req.Sender}
+			return Action{Name: "dunno"}, true // permit local sender
+		}
+		if rsw.autoWhiteListed(req.Sender, req.Time) {
+			rsw.logger.Println("Allowing automatically whitelisted sender:", req.Sender, req.ref())
+			rsw.whiteListed(req)
+			rsw.hit(req, &rsw.hits.autoWhiteList, req.Sender)
+			req.match = ListMatch{Form: MatchAuto, Key: req.Sender}
+			return Action{Name: "dunno"}, true // permit automatically whitelisted sender
+		}
+		m := rsw.matchWhiteList(req)
+		switch m.Form {
+		case MatchSender:
+			rsw.logger.Println("Allowing whitelisted sender:", m.Key, req.ref(), rsw.whiteListNote(m.Key))
+		case MatchSubAddress:
+			rsw.logger.Println("Allowing whitelisted sender:", m.Key, "for sender:", req.Sender, req.ref(), rsw.whiteListNote(m.Key))
+		case MatchDomain:
+			rsw.logger.Println("Allowing whitelisted domain:", m.Key, "for sender:", req.Sender, req.ref(), rsw.whiteListNote(m.Key))
+		case MatchClient:
+			rsw.logger.Println("Allowing whitelisted client:", m.Key, "for sender:", req.Sender, req.ref(), rsw.whiteListNote(m.Key))
+		default:
+			return Action{}, false
+		}
+		rsw.whiteListed(req)
+		rsw.hit(req, &rsw.hits.whiteList, m.Key)
+		req.match = m
+		return rsw.whiteListAction(), true // permit whitelisted sender or domain
+	})
 }
 
-// SetDeferMessage sets the defer message sent to the client in case the limit is exceeded
-func (rsw *RatelimitSlidingWindow) SetDeferMessage(m string) {
-	rsw.mu.Lock()
-	defer rsw.mu.Unlock()
-	rsw.deferMessage = m
+// matchWhiteList returns the white list entry matching the sender, its address without the sub address, its domain or
+// the client address the message is keyed by
+func (rsw *RatelimitSlidingWindow) matchWhiteList(req *RatelimitRequest) ListMatch {
+	if k, ok := rsw.checkWhiteList(req.Sender); ok {
+		return ListMatch{Form: MatchSender, Key: k}
+	}
+	if stripped := stripSubAddress(req.Sender); rsw.subAddress && stripped != req.Sender {
+		if k, ok := rsw.checkWhiteList(stripped); ok {
+			return ListMatch{Form: MatchSubAddress, Key: k}
+		}
+	}
+	if k, ok := rsw.lookupDomain(rsw.whiteList, req.Domain); ok {
+		return ListMatch{Form: MatchDomain, Key: k}
+	}
+	if req.Key != req.Sender && net.ParseIP(req.Key) != nil {
+		if k, ok := rsw.checkWhiteList(req.Key); ok {
+			return ListMatch{Form: MatchClient, Key: k}
+		}
+	}
+	return ListMatch{}
 }
 
-// SetWhiteList sets the white list
-func (rsw *RatelimitSlidingWindow) SetWhiteList(wl *MemoryMap) {
-	rsw.mu.Lock()
-	defer rsw.mu.Unlock()
-	rsw.whiteList = wl
+// LimitPolicy returns the policy setting the limit of senders with an override or whose domain is on the domain list,
+// a domain list entry may also set the interval the limit applies to like "partner.com 50 10m".
+// A pair list entry of the sender and recipient domain takes precedence, accounting the message under the pair.
+// The new sender limit and then the soft white list adjust the limit last.
+func (rsw *RatelimitSlidingWindow) LimitPolicy() PolicyRule {
+	return PolicyFunc(func(req *RatelimitRequest) (Action, bool) {
+		if req.keyLimit > 0 {
+			req.Limit = req.keyLimit
+			return Action{}, false
+		}
+		if listed, unlimited := rsw.checkPair(req); unlimited {
+			rsw.logger.Println("Allowing unlimited sender:", req.Sender, "for recipient:", req.Recipient, req.ref())
+			rsw.whiteListed(req)
+			return Action{Name: "dunno"}, true // permit pair listed without a limit
+		} else if listed {
+			return Action{}, false
+		}
+		token := rsw.token(req)
+		if l, ok := token.Override(req.Time); ok && l == Unlimited {
+			rsw.logger.Println("Allowing sender:", req.Sender, "unlimited by an override", req.ref())
+			rsw.whiteListed(req)
+			return Action{Name: "dunno"}, true // permit sender overridden without a limit
+		} else if ok {
+			req.Limit = l
+			return Action{}, false
+		}
+		if listed, unlimited := rsw.checkSender(req); unlimited {
+			rsw.logger.Println("Allowing unlimited sender:", req.Sender, req.ref())
+			rsw.whiteListed(req)
+			return Action{Name: "dunno"}, true // permit sender listed without a limit
+		} else if listed {
+			return Action{}, false
+		}
+		if k, listed := rsw.checkDomain(req.Domain); listed {
+			limit, interval, ok := rsw.getDomainLimit(k)
+			if ok && limit == Unlimited {
+				rsw.logger.Println("Allowing unlimited domain:", k, "for sender:", req.Sender, req.ref())
+				rsw.whiteListed(req)
+				rsw.hit(req, &rsw.hits.domainList, k)
+				return Action{Name: "dunno"}, true // permit domain listed without a limit
+			}
+			if ok {
+				req.Limit = limit
+				if interval > 0 {
+					req.Interval = interval
+				}
+				req.domain = true
+				rsw.hit(req, &rsw.hits.domainList, k)
+			}
+		}
+		rsw.applyNewSender(req, token)
+		if rsw.applySoftWhiteList(req) {
+			rsw.logger.Println("Allowing sender:", req.Sender, "unlimited by the soft white list", req.ref())
+			rsw.whiteListed(req)
+			return Action{Name: "dunno"}, true // permit sender soft listed without a limit
+		}
+		return Action{}, false
+	})
 }
 
-// SetDomainList sets the domain list
-func (rsw *RatelimitSlidingWindow) SetDomainList(d *MemoryMap) {
-	rsw.mu.Lock()
-	defer rsw.mu.Unlock()
-	rsw.domainList = d
+// applySoftWhiteList adjusts the limit of the request by the soft white list entry of its sender or domain, reporting
+// whether the entry is a limit of Unlimited
+func (rsw *RatelimitSlidingWindow) applySoftWhiteList(req *RatelimitRequest) bool {
+	if rsw.softList == nil {
+		return false
+	}
+	k, v, ok := rsw.listEntry(rsw.softList, req.Sender)
+	if !ok {
+		var err error
+		if k, v, err = rsw.softList.GetFold(req.Domain); err != nil || req.Domain == "" {
+			return false
+		}
+	}
+	if strings.HasSuffix(v, "x") {
+		m, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+		if err != nil || m <= 0 {
+			rsw.logger.Println("Invalid soft white list multiplier", v, "for", k)
+			return false
+		}
+		req.Limit = int(float64(req.Limit) * m)
+	} else {
+		l, err := ParseLimit(v)
+		if err != nil {
+			rsw.logger.Println("Invalid soft white list limit", v, "for", k)
+			return false
+		}
+		if l == Unlimited {
+			rsw.hit(req, &rsw.hits.softWhiteList, k)
+			return true
+		}
+		req.Limit = l
+	}
+	rsw.hit(req, &rsw.hits.softWhiteList, k)
+	rsw.logger.Println("Limit of", req.Sender, "raised to", req.Limit, "by soft white list entry", k)
+	return false
 }
 
-func (rsw *RatelimitSlidingWindow) checkWhiteList(k string) bool {
-	if _, err := rsw.whiteList.Get(k); err != nil {
-		return false
+// GlobalPolicy returns the policy deferring messages once the global limit is reached
+func (rsw *RatelimitSlidingWindow) GlobalPolicy() PolicyRule {
+	return PolicyFunc(func(req *RatelimitRequest) (Action, bool) {
+		if rsw.globalLimit > 0 {
+			req.hold(rsw.global)
+		}
+		if !rsw.checkGlobal(req.Time.Add(rsw.interval), req.needed()) {
+			if req.DryRun {
+				return rsw.deferAction(""), true
+			}
+			rsw.logRejection(req.Sender, req.Time, "Message from", req.Sender, "rejected by the global limit", rsw.globalLimit, "regardless of its own limit", req.ref())
+			excess := rsw.global.count64() + int64(req.needed()) - int64(rsw.globalLimit)
+			req.retry = rsw.global.retryAfter(req.Time, -rsw.interval, excess)
+			a := rsw.deferAction("global")
+			a.Text = rsw.globalMsg
+			return a, true
+		}
+		req.global = rsw.globalLimit > 0
+		return Action{}, false
+	})
+}
+
+// SenderPolicy returns the policy deferring messages of senders who reached their limit
+func (rsw *RatelimitSlidingWindow) SenderPolicy() PolicyRule {
+	return PolicyFunc(func(req *RatelimitRequest) (Action, bool) {
+		if req.Recipients > req.Limit {
+			rsw.logger.Println("WARNING: message from", req.Sender, "has", req.Recipients, "recipients, more than the entire limit", req.Limit)
+			if rsw.rejectLarge {
+				return Action{Name: "reject", Text: rsw.deferMessage, Reason: "rl-size"}, true // deferring would never succeed
+			}
+		}
+
+		token := rsw.token(req)
+		req.hold(token)
+
+		if rsw.decay {
+			req.count = int64(math.Round(token.decayed(req.Time))) * int64(rsw.sampleRate)
+		} else {
+			token.Prune(req.Time.Add(-req.Interval))
+			req.count = token.count64() * int64(rsw.sampleRate)
+		}
+		tcount := req.count + int64(req.needed()) // int64 so a huge recipient count cannot wrap around
+
+		over := tcount > int64(req.Limit)
+		if rsw.avgRate > 0 && !rsw.decay {
+			over = rsw.overAverage(req, token, tcount)
+		}
+		if over {
+			if req.DryRun {
+				return rsw.deferAction(""), true
+			}
+			rsw.logRejection(req.Sender, req.Time, "Message from", req.Sender, "rejected, limit", req.Limit, "reached (", tcount, ")", req.ref())
+			token.markDeferred(req.Time)
+			rsw.autoDemote(req.Sender)
+			if rsw.decay {
+				rate := float64(rsw.sampleRate)
+				req.retry = token.decayRetryAfter(req.Time, req.Interval, float64(req.Limit)/rate, float64(req.needed())/rate)
+			} else if rsw.avgRate == 0 { // overAverage already set the retry time of the average
+				excess := (tcount - int64(req.Limit) + int64(rsw.sampleRate) - 1) / int64(rsw.sampleRate) // in recorded messages
+				req.retry = token.retryAfter(req.Time, req.Interval, excess)
+			}
+			if req.domain {
+				return rsw.deferAction("rl-domain"), true
+			}
+			return rsw.deferAction("rl-sender"), true
+		}
+		req.token = token
+		return Action{}, false
+	})
+}
+
+// RateLimit checks whether a sender can send the message and returns the appropriate postfix policy action string
+func (rsw *RatelimitSlidingWindow) RateLimit(sender string, recips int) string {
+	return rsw.Decide(sender, recips).Response
+}
+
+// WouldPermit reports whether a message of the sender would be permitted now, running the whole policy chain without
+// recording the message or counting the decision
+func (rsw *RatelimitSlidingWindow) WouldPermit(sender string, recips int) bool {
+	return rsw.decide(&RatelimitRequest{Sender: sender, Recipients: recips, DryRun: true}).Permitted()
+}
+
+// token returns the token of the key of the request, a dry run gets a new one not added to the map if the key has none
+func (rsw *RatelimitSlidingWindow) token(req *RatelimitRequest) *RatelimitToken {
+	if !req.DryRun {
+		return rsw.tokens.Token(req.Key)
 	}
-	return true
+	if t, ok := rsw.tokens.lookup(req.Key); ok {
+		return t
+	}
+	t := NewRatelimitToken(req.Key)
+	t.slice = rsw.slice
+	t.SetLogger(rsw.logger)
+	return t
 }
 
-func (rsw *RatelimitSlidingWindow) checkDomain(k string) bool {
-	if _, err := rsw.domainList.Get(k); err != nil {
-		return false
+// whiteListed counts a message permitted by the white list policy unless the request is a dry run
+func (rsw *RatelimitSlidingWindow) whiteListed(req *RatelimitRequest) {
+	if !req.DryRun {
+		atomic.AddInt64(&rsw.counters.Whitelisted, 1)
 	}
-	return true
 }
 
-func (rsw *RatelimitSlidingWindow) getDomainLimit(dom string) int {
-	d, err := rsw.domainList.Get(dom)
-	if err != nil {
-		rsw.logger.Println("Failed to get domain data for:", dom)
-		return 0
+// hit counts a hit of a list entry unless the request is a dry run
+func (rsw *RatelimitSlidingWindow) hit(req *RatelimitRequest, hc *hitCounter, k string) {
+	if !req.DryRun {
+		hc.hit(k)
+	}
+}
+
+// RateLimitRecipient checks whether a sender can send the message to a recipient, applying the pair list entry of the
+// sender and recipient domain if there is one
+func (rsw *RatelimitSlidingWindow) RateLimitRecipient(sender, recipient string, recips int) string {
+	d := rsw.decide(&RatelimitRequest{Sender: sender, Recipient: recipient, Recipients: recips})
+	rsw.observe(d)
+	return d.Response
+}
+
+// Decide checks whether a sender can send the message like RateLimit, returning the whole decision
+func (rsw *RatelimitSlidingWindow) Decide(sender string, recips int) Decision {
+	d := rsw.decide(&RatelimitRequest{Sender: sender, Recipients: recips})
+	rsw.observe(d)
+	return d
+}
+
+// RateLimitRequest extracts the sender, recipient and recipient_count attributes from a policy request and rate limits the sender with them
+func (rsw *RatelimitSlidingWindow) RateLimitRequest(p *Policy) string {
+	id := requestID(p)
+	res, ok, pending := rsw.decisions.claim(id, rsw.now())
+	if ok {
+		rsw.logger.Println("Repeated request for", id, "from", p.Attribute("sender"), "answered from cache")
+		return res
 	}
-	val, err := strconv.Atoi(d)
+	defer rsw.decisions.put(id, pending, "", time.Time{}) // releases repeated requests if deciding panics
+	recips, err := strconv.Atoi(p.Attribute("recipient_count"))
 	if err != nil {
-		rsw.logger.Println("Cannot convert value ", d, " to int")
-		return 0
+		recips = 0 // absent, handled like a zero count of the stages before DATA
+	}
+	req := &RatelimitRequest{
+		Sender:     p.Attribute("sender"),
+		Recipients: recips,
+		Recipient:  p.Attribute("recipient"),
+		QueueID:    p.Attribute("queue_id"),
+		Instance:   p.Attribute("instance"),
+	}
+	rsw.mu.RLock()
+	extract := rsw.extractor
+	rsw.mu.RUnlock()
+	if extract != nil {
+		if key, limit, ok := extract(p); ok {
+			req.Key = key
+			req.keyLimit = limit
+		}
 	}
-	return val
+	d := rsw.decide(req)
+	rsw.decisions.put(id, pending, d.Response, rsw.now())
+	rsw.observe(d)
+	return d.Response
 }
 
-// RateLimit checks whether a sender can send the message and returns the appropriate postfix policy action string
-func (rsw *RatelimitSlidingWindow) RateLimit(sender string, recips int) string {
+// SetOnDecision sets a function called with every decision, it is called without holding any lock so it may block,
+// but it delays the response to postfix while it runs
+func (rsw *RatelimitSlidingWindow) SetOnDecision(f func(Decision)) {
 	rsw.mu.Lock()
 	defer rsw.mu.Unlock()
-	elems := strings.Split(sender, "@")
-	//	user := elems[0] // the user part of sender
-	domain := "" // domain defaults to empty
-	messagelimit := rsw.defaultLimit
-	if len(elems) > 1 {
-		domain = elems[1] // the domain part of sender
+	rsw.onDecision = f
+}
+
+func (rsw *RatelimitSlidingWindow) observe(d Decision) {
+	rsw.mu.RLock()
+	f := rsw.onDecision
+	rsw.mu.RUnlock()
+	if f != nil {
+		f(d)
 	}
+}
 
-	if recips == 0 {
-		rsw.logger.Println("Recipients is 0, increasing to 1")
-		recips++
+// decision builds the Decision of a request, formatting its response
+func (rsw *RatelimitSlidingWindow) decision(req *RatelimitRequest, a Action) Decision {
+	d := Decision{
+		Sender:     req.Sender,
+		Key:        req.Key,
+		Domain:     req.Domain,
+		Recipients: req.Recipients,
+		Count:      req.count,
+		Limit:      req.Limit,
+		RetryAfter: rsw.jitter(req, req.retry),
+		QueueID:    req.QueueID,
+		Instance:   req.Instance,
+		Time:       req.Time,
+		WhiteList:  req.match,
+	}
+	if !a.permits() {
+		a.Text = expandMessage(a.Text, d)
 	}
+	d.Action = a
+	d.Response = rsw.response(a)
+	return d
+}
 
-	if rsw.checkWhiteList(sender) {
-		rsw.logger.Println("Allowing whitelisted sender:", sender)
-		return "action=dunno\n\n" // permit whitelisted sender
+func (rsw *RatelimitSlidingWindow) decide(req *RatelimitRequest) Decision {
+	rsw.mu.RLock()
+	defer rsw.mu.RUnlock()
+	defer req.release()
+	if !req.DryRun {
+		atomic.AddInt64(&rsw.counters.Requests, 1)
+	}
+	req.Sender = rsw.normalize(req.Sender)
+	elems := strings.Split(req.Sender, "@")
+	//	user := elems[0] // the user part of sender
+	req.Domain = "" // domain defaults to empty
+	if len(elems) > 1 {
+		req.Domain = elems[1] // the domain part of sender
 	}
-	if rsw.checkWhiteList(domain) {
-		rsw.logger.Println("Allowing whitelisted domain:", domain, "for sender:", sender)
-		return "action=dunno\n\n" // permit whitelisted domain
+
+	if req.Recipients == 0 {
+		switch rsw.zeroRecips {
+		case ZeroAsOne:
+			rsw.logger.Println("Recipients is 0, increasing to 1")
+			req.Recipients++
+		case ZeroReject:
+			rsw.logger.Println("Message from", req.Sender, "rejected, recipient count is 0", req.ref())
+			return rsw.decision(req, Action{Name: "reject", Text: "invalid recipient count", Reason: "rl-recipients"})
+		}
 	}
-	if rsw.checkDomain(domain) {
-		messagelimit = rsw.getDomainLimit(domain)
+	if req.Recipients < 0 || (rsw.maxRecips > 0 && req.Recipients > rsw.maxRecips) {
+		rsw.logger.Println("Message from", req.Sender, "rejected, invalid recipient count", req.Recipients, req.ref())
+		return rsw.decision(req, Action{Name: "reject", Text: "invalid recipient count", Reason: "rl-recipients"})
 	}
 
-	token := rsw.tokens.Token(sender)
+	if req.Key == "" {
+		req.Key = req.Sender
+	}
+	req.Limit = rsw.defaultLimit
+	req.Interval = rsw.interval * -1
+	req.Time = rsw.now()
 
-	now := time.Now()
+	chain := rsw.chain
+	if chain == nil {
+		chain = rsw.defaultChain()
+	}
+	action, ok := chain.Evaluate(req)
+	if !ok {
+		action = Action{Name: "dunno"}
+	}
+	if req.DryRun {
+		if rsw.paused {
+			action = Action{Name: "dunno"}
+		}
+		return rsw.decision(req, action)
+	}
+	if !action.permits() && rsw.paused {
+		rsw.logger.Println("Enforcement paused, permitting message from", req.Sender, "that would get", action.Name, req.ref())
+		if rsw.globalLimit > 0 {
+			rsw.global.RecordMessage(req.Time, req.Recipients)
+		}
+		rsw.record(rsw.tokens.Token(req.Key), req)
+		return rsw.decision(req, Action{Name: "dunno"})
+	}
+	if !action.permits() {
+		rsw.offenders.reject(req.Sender, req.Time)
+		if action.Reason == "global" {
+			atomic.AddInt64(&rsw.counters.DeferredGlobal, 1)
+		} else if req.domain {
+			atomic.AddInt64(&rsw.counters.DeferredDomain, 1)
+		} else {
+			atomic.AddInt64(&rsw.counters.DeferredDefault, 1)
+		}
+		if rsw.attempts && (action.Reason == "rl-sender" || action.Reason == "rl-domain") {
+			rsw.record(rsw.tokens.Token(req.Key), req)
+		}
+		return rsw.decision(req, action)
+	}
 
-	limit := now.Add(rsw.interval)
+	if req.global {
+		rsw.global.RecordMessage(req.Time, req.Recipients)
+	}
+	if req.token != nil {
+		if rsw.sampleRate == 1 || req.token.sample(rsw.sampleRate) {
+			rsw.record(req.token, req)
+		}
+		if req.domain {
+			atomic.AddInt64(&rsw.counters.PermittedDomain, 1)
+		} else {
+			atomic.AddInt64(&rsw.counters.PermittedDefault, 1)
+		}
+		rsw.logger.Println("Message accepted from", req.Sender, "recipients", req.Recipients, "current", req.token.Count(), "limit", req.Limit, "[", rsw.tokens.len(), "]", req.ref())
+		rsw.autoPromote(req)
+	}
+	return rsw.decision(req, action)
+}
 
-	token.Prune(limit)
-	tcount := token.Count() + recips
+// RatelimitMetrics are the counters of a RatelimitSlidingWindow along with the number of tokens it holds, for monitoring
+type RatelimitMetrics struct {
+	Counters
+	Tokens int // tokens currently held, a gauge unlike the counters
+}
 
-	if tcount > messagelimit {
-		rsw.logger.Println("Message from", sender, "rejected, limit", messagelimit, "reached (", tcount, ")")
-		return "action=defer_if_permit " + rsw.deferMessage + "\n\n"
-	}
+// Metrics returns the counters and the number of tokens, the counters are read without taking any lock
+func (rsw *RatelimitSlidingWindow) Metrics() RatelimitMetrics {
+	return RatelimitMetrics{Counters: rsw.Counters(), Tokens: rsw.tokens.len()}
+}
 
-	token.RecordMessage(now, recips)
+// Counters returns the number of decisions made since the last call to ResetCounters
+func (rsw *RatelimitSlidingWindow) Counters() Counters {
+	var c Counters
+	c.Requests = atomic.LoadInt64(&rsw.counters.Requests)
+	c.Whitelisted = atomic.LoadInt64(&rsw.counters.Whitelisted)
+	c.PermittedDomain = atomic.LoadInt64(&rsw.counters.PermittedDomain)
+	c.PermittedDefault = atomic.LoadInt64(&rsw.counters.PermittedDefault)
+	c.DeferredDomain = atomic.LoadInt64(&rsw.counters.DeferredDomain)
+	c.DeferredDefault = atomic.LoadInt64(&rsw.counters.DeferredDefault)
+	c.DeferredGlobal = atomic.LoadInt64(&rsw.counters.DeferredGlobal)
+	return c
+}
 
-	rsw.logger.Println("Message accepted from", sender, "recipients", recips, "current", token.Count(), "limit", messagelimit, "[", rsw.tokens.len(), "]")
-	return "action=dunno\n\n"
+// ResetCounters zeroes the decision counters
+func (rsw *RatelimitSlidingWindow) ResetCounters() {
+	atomic.StoreInt64(&rsw.counters.Requests, 0)
+	atomic.StoreInt64(&rsw.counters.Whitelisted, 0)
+	atomic.StoreInt64(&rsw.counters.PermittedDomain, 0)
+	atomic.StoreInt64(&rsw.counters.PermittedDefault, 0)
+	atomic.StoreInt64(&rsw.counters.DeferredDomain, 0)
+	atomic.StoreInt64(&rsw.counters.DeferredDefault, 0)
+	atomic.StoreInt64(&rsw.counters.DeferredGlobal, 0)
 }
 
 // Report will log a statistics report
@@ -215,14 +1670,10 @@ func (rsw *RatelimitSlidingWindow) Report() {
 	allslices := 0
 	allcount := 0
 
-	rsw.tokens.mu.Lock()
-	for _, val := range rsw.tokens.tokens {
-		val.mu.Lock()
-		allslices += val.sliceCount
-		allcount += val.count
-		val.mu.Unlock()
+	for _, val := range rsw.tokens.all() {
+		allslices += int(atomic.LoadInt64(&val.sliceCount))
+		allcount += int(atomic.LoadInt64(&val.count))
 	}
-	rsw.tokens.mu.Unlock()
 
 	avg := allslices
 	avgm := allcount
@@ -237,39 +1688,126 @@ func (rsw *RatelimitSlidingWindow) Report() {
 
 }
 
+// RatelimitStats is a snapshot of the configuration and state of a RatelimitSlidingWindow
+type RatelimitStats struct {
+	DefaultLimit   int
+	Interval       time.Duration
+	SliceDuration  time.Duration
+	WhiteListSize  int
+	DomainListSize int
+	Tokens         int
+	TokenStats     TokenStats
+	GlobalLimit    int
+	GlobalCount    int
+	GlobalDeferred int64 // messages deferred because of the global limit since the counters were reset
+	Paused         bool
+	AutoWhiteList  int
+	Lists          []ListStatus
+}
+
+// Stats returns the current configuration and state of the RatelimitSlidingWindow
+func (rsw *RatelimitSlidingWindow) Stats() RatelimitStats {
+	rsw.mu.Lock()
+	defer rsw.mu.Unlock()
+
+	var st RatelimitStats
+	st.DefaultLimit = rsw.defaultLimit
+	st.Interval = rsw.interval * -1
+	st.SliceDuration = rsw.slice
+	if rsw.whiteList != nil {
+		st.WhiteListSize = rsw.whiteList.Len()
+	}
+	if rsw.domainList != nil {
+		st.DomainListSize = rsw.domainList.Len()
+	}
+	st.TokenStats = rsw.tokens.Stats()
+	st.Tokens = st.TokenStats.Tokens
+	st.GlobalLimit = rsw.globalLimit
+	rsw.global.Prune(rsw.now().Add(rsw.interval))
+	st.GlobalCount = rsw.global.Count()
+	rsw.auto.mu.RLock()
+	st.AutoWhiteList = len(rsw.auto.senders)
+	rsw.auto.mu.RUnlock()
+	st.GlobalDeferred = atomic.LoadInt64(&rsw.counters.DeferredGlobal)
+	st.Paused = rsw.paused
+	st.Lists = rsw.listStatus()
+
+	return st
+}
+
+// String is a simple stringer summarizing the RatelimitSlidingWindow
+func (rsw *RatelimitSlidingWindow) String() string {
+	st := rsw.Stats()
+	return fmt.Sprintf("RatelimitSlidingWindow: limit %d interval %s slice %s whitelist %d domains %d tokens %d",
+		st.DefaultLimit, st.Interval, st.SliceDuration, st.WhiteListSize, st.DomainListSize, st.Tokens)
+}
+
 // AddToken adds a new token to a RatelimitTokenMap
 func (rlm *RatelimitTokenMap) AddToken(t *RatelimitToken) {
 	rlm.mu.Lock()
 	defer rlm.mu.Unlock()
-	rlm.tokens[t.Key()] = t
+	rlm.insert(t)
 }
 
-// Token returns a token from a RatelimitTokenMap
+// Token returns a token from a RatelimitTokenMap, only the shard of the key is locked unless the token is created
 func (rlm *RatelimitTokenMap) Token(k string) *RatelimitToken {
-	rlm.mu.Lock()
-	defer rlm.mu.Unlock()
-	if t, ok := rlm.tokens[k]; ok {
-		return t
-	} else {
-		t := NewRatelimitToken(k)
-		t.SetLogger(rlm.logger)
-		rlm.tokens[k] = t
+	sh := rlm.shard(k)
+	sh.mu.Lock()
+	t, ok := sh.tokens[k]
+	if ok {
+		t.used = rlm.now()
+	}
+	sh.mu.Unlock()
+	if ok {
 		return t
 	}
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	return rlm.localtoken(k)
+}
+
+// lookup returns the token of k without creating it
+func (rlm *RatelimitTokenMap) lookup(k string) (*RatelimitToken, bool) {
+	sh := rlm.shard(k)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	t, ok := sh.tokens[k]
+	return t, ok
 }
 
+// localtoken returns the token of k like Token, creating it if there is none, with mu held
 func (rlm *RatelimitTokenMap) localtoken(k string) *RatelimitToken {
-	if t, ok := rlm.tokens[k]; ok {
-		return t
-	} else {
-		t := NewRatelimitToken(k)
-		t.SetLogger(rlm.logger)
-		rlm.tokens[k] = t
+	if t, ok := rlm.lookup(k); ok {
 		return t
 	}
+	t := NewRatelimitToken(k)
+	t.SetLogger(rlm.logger)
+	rlm.insert(t)
+	return t
+}
+
+// TokenSummary is a copy of the state of a RatelimitToken that shares nothing with it
+type TokenSummary struct {
+	Key      string
+	Count    int
+	LastSeen time.Time
+}
+
+// Snapshot returns a summary of every token, the map is only locked while the tokens are collected
+func (rlm *RatelimitTokenMap) Snapshot() []TokenSummary {
+	tokens := rlm.all()
+
+	res := make([]TokenSummary, 0, len(tokens))
+	for _, t := range tokens {
+		t.mu.Lock()
+		res = append(res, TokenSummary{Key: t.key, Count: t.Count(), LastSeen: t.lastSeen})
+		t.mu.Unlock()
+	}
+	return res
 }
+
 func (rlm *RatelimitTokenMap) len() int {
-	return len(rlm.tokens)
+	return int(atomic.LoadInt64(&rlm.n))
 }
 
 func (rsw *RatelimitSlidingWindow) SaveTokens(filename string) bool {
@@ -286,6 +1824,22 @@ func (rsw *RatelimitSlidingWindow) LoadTokens(filename string) bool {
 	return rsw.tokens.LoadFile(filename)
 }
 
+// ImportCounts seeds the tokens of the given keys with an approximate count of recent messages, like one taken from the
+// mail logs after a restart. Every count is recorded in a single slice at the given time and expires with it as usual.
+func (rsw *RatelimitSlidingWindow) ImportCounts(counts map[string]int, at time.Time) {
+	rsw.mu.RLock()
+	defer rsw.mu.RUnlock()
+	n := 0
+	for k, c := range counts {
+		if c < 1 {
+			continue
+		}
+		rsw.tokens.Token(rsw.normalize(k)).record(at, c, rsw.sliceCap(rsw.interval*-1))
+		n++
+	}
+	rsw.logger.Println("Imported the counts of", n, "senders at", at)
+}
+
 func (rlm *RatelimitTokenMap) Serialize(filename string) bool {
 	rlm.mu.Lock()
 	defer rlm.mu.Unlock()
@@ -362,8 +1916,8 @@ func (rlm *RatelimitTokenMap) LoadFile(filename string) bool {
 
 func (rlm *RatelimitTokenMap) String() string {
 	var s string
-	for _, v := range rlm.tokens {
-		s = fmt.Sprintf("%s%s>%s\n", s, v.key, v)
+	for _, v := range rlm.all() {
+		s = fmt.Sprintf("%s%s>%s\n", s, v.key, v.encode())
 	}
 	return s
 }
@@ -377,47 +1931,237 @@ func (rlt *RatelimitToken) Key() string {
 
 // RecordMessage records a message in the RatelimitToken by updating or adding a timeslice
 func (rlt *RatelimitToken) RecordMessage(ts time.Time, recips int) {
+	rlt.record(ts, recips, 0)
+}
+
+// record records a message like RecordMessage and drops the oldest slices if more than maxSlices remain, 0 means no cap
+func (rlt *RatelimitToken) record(ts time.Time, recips int, maxSlices int) {
 	rlt.mu.Lock()
 	defer rlt.mu.Unlock()
-	keytime := ts.Truncate(time.Minute)
-	rlt.logger.Println("Recording message for", rlt.key, "count:", rlt.count, "slices:", rlt.sliceCount, "time:", keytime, "recipients:", recips)
-	if val, ok := rlt.tsd[keytime]; ok {
-		rlt.count += recips
-		rlt.tsd[keytime] = val + recips
+	if ts.After(rlt.lastSeen) {
+		rlt.lastSeen = ts
+	}
+	if rlt.clean.IsZero() {
+		rlt.clean = ts
+	}
+	if rlt.firstSeen.IsZero() || ts.Before(rlt.firstSeen) {
+		rlt.firstSeen = ts
+	}
+	if recips == 0 {
+		return // ZeroAsZero, the sender was seen but there is nothing to count
+	}
+	idx := rlt.index(ts)
+	rlt.logger.Println("Recording message for", rlt.key, "count:", rlt.count, "slices:", rlt.sliceCount, "time:", rlt.start(idx), "recipients:", recips)
+	if val, ok := rlt.tsd[idx]; ok {
+		atomic.AddInt64(&rlt.count, int64(recips))
+		rlt.tsd[idx] = val + recips
 	} else {
-		rlt.count += recips
-		rlt.sliceCount++
-		rlt.tsd[keytime] = recips
+		atomic.AddInt64(&rlt.count, int64(recips))
+		atomic.AddInt64(&rlt.sliceCount, 1)
+		rlt.tsd[idx] = recips
+	}
+	for maxSlices > 0 && len(rlt.tsd) > maxSlices {
+		oldest := idx
+		for i := range rlt.tsd {
+			if i < oldest {
+				oldest = i
+			}
+		}
+		rlt.logger.Println("Capping", rlt.key, "at", maxSlices, "slices, dropping slice", rlt.start(oldest), "containing", rlt.tsd[oldest], "entries")
+		rlt.drop(oldest)
+	}
+}
+
+// index returns the index of the slice ts falls in, the number of whole slices since the Unix epoch.
+// Indices only depend on the instant, not on the location or its daylight saving time.
+func (rlt *RatelimitToken) index(ts time.Time) int64 {
+	return sliceIndex(ts, rlt.slice)
+}
+
+// start returns the time the slice of index i starts at
+func (rlt *RatelimitToken) start(i int64) time.Time {
+	return time.Unix(0, i*int64(rlt.slice))
+}
+
+func sliceIndex(ts time.Time, slice time.Duration) int64 {
+	n := ts.UnixNano()
+	i := n / int64(slice)
+	if n < 0 && n%int64(slice) != 0 {
+		i-- // round toward the past before the epoch too
+	}
+	return i
+}
+
+// setSlice changes the duration of the slices of the token, moving the messages of every slice into the new slice
+// its start falls in
+func (rlt *RatelimitToken) setSlice(d time.Duration) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	if d == rlt.slice {
+		return
+	}
+	tsd := make(map[int64]int, len(rlt.tsd))
+	for i, c := range rlt.tsd {
+		tsd[sliceIndex(rlt.start(i), d)] += c
+	}
+	rlt.tsd, rlt.slice = tsd, d
+	atomic.StoreInt64(&rlt.sliceCount, int64(len(tsd)))
+}
+
+// drop removes a slice from the count, keeping it in the history if enabled
+func (rlt *RatelimitToken) drop(i int64) {
+	val := rlt.tsd[i]
+	atomic.AddInt64(&rlt.count, -int64(val))
+	atomic.AddInt64(&rlt.sliceCount, -1)
+	delete(rlt.tsd, i)
+	if rlt.keep < 1 {
+		return
+	}
+	rlt.history = append(rlt.history, SliceCount{Start: rlt.start(i), Count: val})
+	sort.Slice(rlt.history, func(i, j int) bool { return rlt.history[i].Start.Before(rlt.history[j].Start) })
+	if len(rlt.history) > rlt.keep {
+		rlt.history = append(rlt.history[:0], rlt.history[len(rlt.history)-rlt.keep:]...)
+	}
+}
+
+func (rlt *RatelimitToken) setHistory(n int) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	rlt.keep = n
+	if n < 1 {
+		rlt.history = nil
+	} else if len(rlt.history) > n {
+		rlt.history = append(rlt.history[:0], rlt.history[len(rlt.history)-n:]...)
+	}
+}
+
+// History returns the pruned slices kept for diagnostics, oldest first
+func (rlt *RatelimitToken) History() []SliceCount {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	return append([]SliceCount(nil), rlt.history...)
+}
+
+// SetOverride sets a limit for the RatelimitToken that takes precedence over the domain and default limits until the given time
+func (rlt *RatelimitToken) SetOverride(limit int, until time.Time) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	rlt.override = limit
+	rlt.overrideTo = until
+}
+
+// Override returns the override limit of the RatelimitToken if it is still valid at the given time
+func (rlt *RatelimitToken) Override(now time.Time) (int, bool) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	if rlt.overrideTo.IsZero() || !now.Before(rlt.overrideTo) {
+		return 0, false
+	}
+	return rlt.override, true
+}
+
+// sample reports whether the current message is the one in every n that gets recorded
+func (rlt *RatelimitToken) sample(n int) bool {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	rlt.seen++
+	if rlt.seen >= n {
+		rlt.seen = 0
+		return true
 	}
+	return false
+}
+
+// markDeferred records that a message of the sender was deferred
+func (rlt *RatelimitToken) markDeferred(ts time.Time) {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	rlt.clean = ts
+}
+
+// first returns when the first message of the token was recorded, zero if none was
+func (rlt *RatelimitToken) first() time.Time {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	return rlt.firstSeen
+}
+
+// cleanSince returns the time since the sender had no message deferred
+func (rlt *RatelimitToken) cleanSince() time.Time {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	return rlt.clean
 }
 
-// Count returns the number of messages currently in the Token, make sure to call Prune before calling this
+func (rlt *RatelimitToken) count64() int64 {
+	return atomic.LoadInt64(&rlt.count)
+}
+
+// Count returns the number of messages currently in the Token, make sure to call Prune before calling this.
+// For tokens accounted with decay it returns the decayed count at the current time of the window instead.
 func (rlt *RatelimitToken) Count() int {
+	if atomic.LoadInt64(&rlt.tau) > 0 {
+		return int(math.Round(rlt.decayed(rlt.now())))
+	}
+	return int(atomic.LoadInt64(&rlt.count))
+}
+
+// now returns the time of the map holding the token, the system time for a token on its own
+func (rlt *RatelimitToken) now() time.Time {
+	if rlt.clock != nil {
+		return rlt.clock()
+	}
+	return time.Now()
+}
+
+// retryAfter returns how long until enough slices expire to free excess messages, the interval if they never do
+func (rlt *RatelimitToken) retryAfter(now time.Time, interval time.Duration, excess int64) time.Duration {
 	rlt.mu.Lock()
 	defer rlt.mu.Unlock()
-	return rlt.count
+	idx := make([]int64, 0, len(rlt.tsd))
+	for i := range rlt.tsd {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(a, b int) bool { return idx[a] < idx[b] })
+	var freed int64
+	for _, i := range idx {
+		freed += int64(rlt.tsd[i])
+		if freed >= excess {
+			if d := rlt.start(i + 1).Add(interval).Sub(now); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	return interval
 }
 
-// Prune clears all expired time slices from a RatelimitToken
+// Prune clears all expired time slices from a RatelimitToken, a slice expires once it ends at or before lim.
+// Expiring slices by their start would drop messages at the end of a slice while they are still within the window,
+// so the count errs on the side of keeping a message up to one slice too long.
 func (rlt *RatelimitToken) Prune(lim time.Time) {
 	rlt.mu.Lock()
 	defer rlt.mu.Unlock()
-	for t, val := range rlt.tsd {
-		if t.Before(lim) {
-			rlt.logger.Println("Pruning", rlt.key, "slice with key:", t, "containing", val, "entries")
-			rlt.count -= val
-			rlt.sliceCount--
-			delete(rlt.tsd, t)
+	for i, val := range rlt.tsd {
+		if !rlt.start(i + 1).After(lim) {
+			rlt.logger.Println("Pruning", rlt.key, "slice with key:", rlt.start(i), "containing", val, "entries")
+			rlt.drop(i)
 		}
 	}
 }
 
-// String is a simple stringer for the RatelimitToken
+// String is a simple stringer for the RatelimitToken, it takes no lock so it is safe to call while the token is locked
 func (rlt *RatelimitToken) String() string {
-	//s := fmt.Sprintf("RatelimitToken: %s count %d slices %d", rlt.key, rlt.count, rlt.sliceCount)
+	return fmt.Sprintf("RatelimitToken: %s count %d slices %d", rlt.key, atomic.LoadInt64(&rlt.count), atomic.LoadInt64(&rlt.sliceCount))
+}
+
+// encode returns the time slices of the RatelimitToken in the format used by Serialize
+func (rlt *RatelimitToken) encode() string {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
 	var s string
 	for k, v := range rlt.tsd {
-		s = fmt.Sprintf("%s%s/%d#", s, k.Format(time.UnixDate), v)
+		s = fmt.Sprintf("%s%s/%d#", s, rlt.start(k).Format(time.UnixDate), v)
 	}
 	return s
 }
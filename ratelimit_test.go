@@ -0,0 +1,745 @@
+package postfix
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func BenchmarkRateLimitParallel(b *testing.B) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(64))
+	rsw.SetDefaultLimit(1 << 30)
+	senders := make([]string, 1024)
+	for i := range senders {
+		senders[i] = "user" + strconv.Itoa(i) + "@example.com"
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rsw.RateLimit(senders[i%len(senders)], 1)
+			i++
+		}
+	})
+}
+
+func BenchmarkRateLimitParallelAutoWhiteList(b *testing.B) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(64))
+	rsw.SetDefaultLimit(1 << 30)
+	rsw.SetAutoWhiteList(1, 0)
+	senders := make([]string, 1024)
+	for i := range senders {
+		senders[i] = "user" + strconv.Itoa(i) + "@example.com"
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rsw.RateLimit(senders[i%len(senders)], 1)
+			i++
+		}
+	})
+}
+
+func TestAutoWhiteListDisabledTakesNoLock(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.auto.mu.Lock()
+	defer rsw.auto.mu.Unlock()
+	done := make(chan string)
+	go func() { done <- rsw.RateLimit("bob@example.com", 1) }()
+	select {
+	case got := <-done:
+		if got != "action=dunno\n\n" {
+			t.Fatalf("RateLimit = %q, want dunno", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RateLimit blocked on the lock of the disabled automatic white list")
+	}
+}
+
+func TestBusySenderDoesNotBlockOthers(t *testing.T) {
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetDefaultLimit(10)
+	bob := tokens.Token("bob@example.com")
+	bob.busy.Lock()
+	done := make(chan string)
+	go func() { done <- rsw.RateLimit("alice@example.com", 1) }()
+	select {
+	case got := <-done:
+		if got != "action=dunno\n\n" {
+			t.Errorf("RateLimit = %q, want dunno", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a decision for alice@example.com waited for the one of bob@example.com")
+	}
+	bob.busy.Unlock()
+}
+
+func TestListKeysFoldCase(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"Bob@Example.com": "", "Partner.ORG": ""})
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	for _, s := range []string{"bob@example.com", "BOB@EXAMPLE.COM", "alice@partner.org", "alice@Partner.Org"} {
+		for i := 0; i < 3; i++ {
+			if got := rsw.RateLimit(s, 1); got != "action=dunno\n\n" {
+				t.Fatalf("message %d of %s = %q, want the white list to match", i, s, got)
+			}
+		}
+	}
+	if got := rsw.Counters().Whitelisted; got != 12 {
+		t.Errorf("whitelisted %d messages, want 12", got)
+	}
+}
+
+func TestListKeysLocalPartCase(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"Bob@Example.com": ""})
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	rsw.SetFoldCase(false)
+
+	rsw.RateLimit("Bob@example.com", 1)
+	if got := rsw.Counters().Whitelisted; got != 1 {
+		t.Errorf("Bob@example.com whitelisted %d times, want the domain to match regardless of case", got)
+	}
+	rsw.RateLimit("bob@example.com", 1)
+	if got := rsw.Counters().Whitelisted; got != 1 {
+		t.Errorf("bob@example.com matched Bob@Example.com with case folding off")
+	}
+}
+
+func TestSetOverrideNormalizesSender(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	rsw.SetStripSubAddress(true)
+	rsw.SetOverride("Bob+News@Example.com", 3, time.Now().Add(time.Hour))
+
+	for i := 0; i < 3; i++ {
+		if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d = %q, want the override of 3 to apply", i, got)
+		}
+	}
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("fourth message permitted over the override")
+	}
+}
+
+func TestImportCountsNormalizesSender(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(5)
+	rsw.ImportCounts(map[string]int{"Bob@Example.com": 5}, time.Now())
+
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("message permitted although the imported count reached the limit")
+	}
+}
+
+func TestDomainLimitUnlimited(t *testing.T) {
+	dl := NewMemoryMapFrom(map[string]string{"example.com": "0", "example.org": "lots"})
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), dl, NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	for i := 0; i < 5; i++ {
+		if got := rsw.RateLimit("bob@example.com", 10); got != "action=dunno\n\n" {
+			t.Fatalf("message %d of an unlimited domain = %q", i, got)
+		}
+	}
+	rsw.RateLimit("bob@example.org", 1)
+	if got := rsw.RateLimit("bob@example.org", 1); got == "action=dunno\n\n" {
+		t.Error("an invalid domain limit did not leave the domain at the default limit")
+	}
+}
+
+func TestOverrideUnlimited(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	until := time.Now().Add(time.Hour)
+	rsw.SetOverride("bob@example.com", Unlimited, until)
+
+	for i := 0; i < 5; i++ {
+		if got := rsw.RateLimit("bob@example.com", 10); got != "action=dunno\n\n" {
+			t.Fatalf("message %d under an unlimited override = %q", i, got)
+		}
+	}
+	if got := rsw.RateLimit("alice@example.com", 2); got == "action=dunno\n\n" {
+		t.Error("the override applied to another sender")
+	}
+}
+
+func TestSoftWhiteListUnlimited(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	rsw.SetSoftWhiteList(NewMemoryMapFrom(map[string]string{"bob@example.com": "0", "example.org": "3x"}))
+
+	for i := 0; i < 5; i++ {
+		if got := rsw.RateLimit("bob@example.com", 10); got != "action=dunno\n\n" {
+			t.Fatalf("message %d of an unlimited soft listed sender = %q", i, got)
+		}
+	}
+	if got := rsw.RateLimit("alice@example.org", 3); got != "action=dunno\n\n" {
+		t.Errorf("3 recipients under a 3x multiplier = %q", got)
+	}
+	if got := rsw.RateLimit("alice@example.org", 1); got == "action=dunno\n\n" {
+		t.Error("a message over the multiplied limit was permitted")
+	}
+}
+
+func TestTokenMapCap(t *testing.T) {
+	var logs bytes.Buffer
+	tokens := NewRatelimitTokenMap(4)
+	tokens.SetLogger(log.New(&logs, "", 0))
+	tokens.SetMaxTokens(100)
+	tokens.SetHighWater(50)
+
+	for i := 0; i < 500; i++ {
+		tokens.Token("user" + strconv.Itoa(i) + "@example.com")
+	}
+	st := tokens.Stats()
+	if st.Tokens != 100 || st.Evicted != 400 {
+		t.Errorf("holding %d tokens after evicting %d, want 100 after 400", st.Tokens, st.Evicted)
+	}
+	if st.HighWater != 50 || st.Peak != 101 {
+		t.Errorf("high water %d peak %d, want 50 and 101", st.HighWater, st.Peak)
+	}
+	if n := strings.Count(logs.String(), "WARNING: token map holds"); n != 1 {
+		t.Errorf("high water warning logged %d times, want once", n)
+	}
+	if _, ok := tokens.lookup("user499@example.com"); !ok {
+		t.Error("the token just added was evicted")
+	}
+}
+
+func TestTokenMapEvictsLeastRecentlyUsed(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	tokens := NewRatelimitTokenMap(1)
+	NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens).SetClock(mc)
+	tokens.SetMaxTokens(evictSamples)
+
+	for i := 0; i < evictSamples; i++ {
+		tokens.Token("user" + strconv.Itoa(i) + "@example.com")
+		mc.Advance(time.Second)
+	}
+	tokens.Token("user0@example.com") // used again, leaving user1 the least recently used
+	tokens.Token("new@example.com")
+	if _, ok := tokens.lookup("user1@example.com"); ok {
+		t.Error("the least recently used token was kept")
+	}
+	if _, ok := tokens.lookup("user0@example.com"); !ok {
+		t.Error("a token used again was evicted")
+	}
+}
+
+func BenchmarkTokenMapEviction(b *testing.B) {
+	tokens := NewRatelimitTokenMap(DefaultTokenShards)
+	tokens.SetMaxTokens(100000)
+	for i := 0; i < 100000; i++ {
+		tokens.Token("user" + strconv.Itoa(i) + "@example.com")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tokens.Token("new" + strconv.Itoa(i) + "@example.com")
+	}
+}
+
+func TestWhiteListedSenderTakesNoToken(t *testing.T) {
+	tokens := NewRatelimitTokenMap(1)
+	wl := NewMemoryMapFrom(map[string]string{"bob@example.com": "", "partner.org": ""})
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), tokens)
+	rsw.SetDefaultLimit(1)
+
+	for _, s := range []string{"bob@example.com", "alice@partner.org"} {
+		for i := 0; i < 3; i++ {
+			if got := rsw.RateLimit(s, 5); got != "action=dunno\n\n" {
+				t.Fatalf("message %d of whitelisted %s = %q", i, s, got)
+			}
+		}
+	}
+	if n := tokens.Stats().Tokens; n != 0 {
+		t.Errorf("whitelisted senders created %d tokens, want none", n)
+	}
+}
+
+func BenchmarkRateLimitWhiteListed(b *testing.B) {
+	wl := NewMemoryMap()
+	senders := make([]string, 100000)
+	for i := range senders {
+		senders[i] = "user" + strconv.Itoa(i) + "@example.com"
+		wl.Add(senders[i], "")
+	}
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), NewRatelimitTokenMap(64))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			rsw.RateLimit(senders[i%len(senders)], 1)
+			i++
+		}
+	})
+}
+
+func TestTokenStringWhileLocked(t *testing.T) {
+	rlt := NewRatelimitToken("bob@example.com")
+	rlt.RecordMessage(time.Now(), 3)
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	done := make(chan string)
+	go func() { done <- rlt.String() }()
+	select {
+	case got := <-done:
+		if want := "RatelimitToken: bob@example.com count 3 slices 1"; got != want {
+			t.Errorf("String = %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("String blocked on the lock of the token")
+	}
+}
+
+func TestMatchSubAddress(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"bob@example.com": ""})
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	rsw.RateLimit("bob+news@example.com", 1)
+	if got := rsw.RateLimit("bob+news@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("bob+news@example.com matched bob@example.com without sub address matching")
+	}
+	rsw.SetMatchSubAddress(true)
+	for i := 0; i < 3; i++ {
+		if got := rsw.RateLimit("bob+news@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d of bob+news@example.com = %q, want it to match bob@example.com", i, got)
+		}
+	}
+}
+
+func TestStripSubAddress(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"bob+news@example.com", "bob@example.com"},
+		{"bob+a+b@example.com", "bob@example.com"},
+		{"bob@example.com", "bob@example.com"},
+		{"bob@ex+ample.com", "bob@ex+ample.com"},
+		{"bob+news", "bob"},
+	} {
+		if got := stripSubAddress(c.in); got != c.want {
+			t.Errorf("stripSubAddress(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestHugeRecipientCountNoWraparound(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(math.MaxInt32)
+
+	if got := rsw.RateLimit("bob@example.com", math.MaxInt32); got != "action=dunno\n\n" {
+		t.Fatalf("a message of exactly the limit = %q, want dunno", got)
+	}
+	for i := 0; i < 3; i++ {
+		if got := rsw.RateLimit("bob@example.com", math.MaxInt32); got == "action=dunno\n\n" {
+			t.Fatalf("message %d over the limit permitted, the count wrapped around", i+2)
+		}
+	}
+	rlt := NewRatelimitToken("alice@example.com")
+	rlt.RecordMessage(time.Now(), math.MaxInt32)
+	rlt.RecordMessage(time.Now(), math.MaxInt32)
+	if got, want := rlt.count64(), int64(2*math.MaxInt32); got != want {
+		t.Errorf("count = %d, want %d", got, want)
+	}
+	if got := rsw.RateLimit("carol@example.com", -1); !strings.HasPrefix(got, "action=reject") {
+		t.Errorf("a negative recipient count = %q, want a reject", got)
+	}
+}
+
+func TestSampleRate(t *testing.T) {
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetDefaultLimit(1000)
+	rsw.SetSampleRate(4)
+
+	for i := 0; i < 40; i++ {
+		rsw.RateLimit("bob@example.com", 1)
+	}
+	tok, ok := tokens.lookup("bob@example.com")
+	if !ok {
+		t.Fatal("no token for bob@example.com")
+	}
+	if got := tok.Count(); got != 10 {
+		t.Errorf("recorded %d of 40 messages sampling 1 in 4, want 10", got)
+	}
+
+	rsw.SetDefaultLimit(20)
+	permitted := 0
+	for rsw.RateLimit("alice@example.com", 1) == "action=dunno\n\n" {
+		if permitted++; permitted > 100 {
+			t.Fatal("sampled sender never deferred")
+		}
+	}
+	if permitted < 20 || permitted > 24 {
+		t.Errorf("permitted %d messages under a limit of 20 sampling 1 in 4, want within one sample of the limit", permitted)
+	}
+}
+
+func TestDeferStatusAndReasons(t *testing.T) {
+	dl := NewMemoryMapFrom(map[string]string{"example.org": "1"})
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), dl, NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	rsw.SetDeferStatus("4.7.28")
+	rsw.SetReasonTags(true)
+
+	rsw.RateLimit("bob@example.com", 1)
+	if got, want := rsw.RateLimit("bob@example.com", 1), "action=defer_if_permit 4.7.28 rate limit exceeded [rl-sender]\n\n"; got != want {
+		t.Errorf("sender defer = %q, want %q", got, want)
+	}
+	rsw.RateLimit("bob@example.org", 1)
+	if got, want := rsw.RateLimit("bob@example.org", 1), "action=defer_if_permit 4.7.28 rate limit exceeded [rl-domain]\n\n"; got != want {
+		t.Errorf("domain defer = %q, want %q", got, want)
+	}
+
+	rsw.SetDefaultLimit(100)
+	rsw.SetGlobalLimit(3)
+	rsw.SetGlobalDeferMessage("relay busy")
+	rsw.RateLimit("alice@example.net", 3)
+	if got, want := rsw.RateLimit("carol@example.net", 1), "action=defer_if_permit 4.7.28 relay busy [global]\n\n"; got != want {
+		t.Errorf("global defer = %q, want %q", got, want)
+	}
+}
+
+func TestListReloadKeepsCounts(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMapFrom(map[string]string{"example.com": "5"}), NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	for i := 0; i < 4; i++ {
+		rsw.RateLimit("bob@example.com", 1)
+	}
+	rsw.SetDomainList(NewMemoryMapFrom(map[string]string{"example.com": "6"}))
+	rsw.SetWhiteList(NewMemoryMapFrom(map[string]string{"alice@example.org": ""}))
+	for i := 0; i < 2; i++ {
+		if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+			t.Fatalf("message %d under the reloaded limit of 6 = %q", i+5, got)
+		}
+	}
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("seventh message permitted, the count did not survive the reload")
+	}
+	if got := rsw.RateLimit("alice@example.org", 5); got != "action=dunno\n\n" {
+		t.Errorf("sender on the reloaded white list = %q", got)
+	}
+}
+
+func TestPruneAtSliceBoundary(t *testing.T) {
+	start := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	rlt := NewRatelimitToken("bob@example.com")
+	rlt.RecordMessage(start.Add(time.Minute-time.Millisecond), 1) // the last instant of the slice starting at 12:00
+	rlt.RecordMessage(start.Add(time.Minute), 2)                  // the first instant of the next slice
+
+	for _, c := range []struct {
+		lim  time.Time
+		want int
+	}{
+		{start, 3},
+		{start.Add(time.Minute - time.Millisecond), 3},
+		{start.Add(time.Minute), 2},
+		{start.Add(2*time.Minute - time.Millisecond), 2},
+		{start.Add(2 * time.Minute), 0},
+	} {
+		rlt.Prune(c.lim)
+		if got := rlt.Count(); got != c.want {
+			t.Errorf("count after pruning at %s = %d, want %d", c.lim.Format("15:04:05.000"), got, c.want)
+		}
+	}
+}
+
+func TestWindowBoundaryKeepsMessageAtSliceEnd(t *testing.T) {
+	mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 59, 0, time.UTC))
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetClock(mc)
+	rsw.SetDefaultLimit(1)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+
+	rsw.RateLimit("bob@example.com", 1) // recorded at the end of its slice
+	mc.Advance(10 * time.Minute)
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("message permitted while the previous one was still within the window")
+	}
+	mc.Advance(time.Second) // the slice of the first message ends now
+	if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+		t.Errorf("message after the window = %q, want it permitted", got)
+	}
+	if got := tokens.Token("bob@example.com").Count(); got != 1 {
+		t.Errorf("count = %d, want only the message just recorded", got)
+	}
+}
+
+func TestWhiteListOK(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"bob@example.com": ""})
+	rsw := NewRatelimitSlidingWindow(wl, NewMemoryMap(), NewRatelimitTokenMap(1))
+	rsw.SetWhiteListOK(true)
+
+	if got := rsw.RateLimit("bob@example.com", 1); got != "action=ok\n\n" {
+		t.Errorf("whitelisted sender = %q, want %q", got, "action=ok\n\n")
+	}
+	if got := rsw.RateLimit("alice@example.com", 1); got != "action=dunno\n\n" {
+		t.Errorf("sender within the limit = %q, want dunno", got)
+	}
+	rsw.SetWhiteListOK(false)
+	if got := rsw.RateLimit("bob@example.com", 1); got != "action=dunno\n\n" {
+		t.Errorf("whitelisted sender without the flag = %q, want dunno", got)
+	}
+}
+
+func TestCountAttempts(t *testing.T) {
+	for _, attempts := range []bool{false, true} {
+		mc := NewManualClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+		tokens := NewRatelimitTokenMap(1)
+		rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+		rsw.SetClock(mc)
+		rsw.SetDefaultLimit(2)
+		rsw.SetCountAttempts(attempts)
+		if err := rsw.SetInterval("10m"); err != nil {
+			t.Fatal(err)
+		}
+
+		rsw.RateLimit("bob@example.com", 1)
+		rsw.RateLimit("bob@example.com", 1)
+		mc.Advance(5 * time.Minute)
+		for i := 0; i < 3; i++ {
+			rsw.RateLimit("bob@example.com", 1) // deferred
+		}
+		want := 2
+		if attempts {
+			want = 5
+		}
+		if got := tokens.Token("bob@example.com").Count(); got != want {
+			t.Errorf("counting attempts %v: counted %d messages, want %d", attempts, got, want)
+		}
+		mc.Advance(7 * time.Minute) // the permitted messages left the window, the attempts did not
+		if got := rsw.RateLimit("bob@example.com", 1); (got == "action=dunno\n\n") == attempts {
+			t.Errorf("counting attempts %v: message after the permitted ones expired = %q", attempts, got)
+		}
+	}
+}
+
+// TestConcurrentRateLimit is meant to be run with -race as well
+func TestConcurrentRateLimit(t *testing.T) {
+	tokens := NewRatelimitTokenMap(8)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), tokens)
+	rsw.SetDefaultLimit(100)
+
+	var permitted int64
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if rsw.RateLimit("bob@example.com", 1) == "action=dunno\n\n" {
+					atomic.AddInt64(&permitted, 1)
+				}
+				rsw.RateLimit("user"+strconv.Itoa(g)+"@example.com", 1)
+				if i%10 == 0 {
+					rsw.SetWhiteList(NewMemoryMapFrom(map[string]string{"alice@example.com": ""}))
+					rsw.SetDomainList(NewMemoryMap())
+					_ = rsw.Stats()
+					_ = tokens.String()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if permitted != 100 {
+		t.Errorf("permitted %d of 800 concurrent messages under a limit of 100", permitted)
+	}
+	if got := tokens.Token("bob@example.com").Count(); got != 100 {
+		t.Errorf("counted %d messages, want 100", got)
+	}
+}
+
+func TestSetInterval(t *testing.T) {
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+	for _, c := range []struct {
+		in   string
+		want time.Duration
+	}{
+		{"120s", 2 * time.Minute},
+		{"5m", 5 * time.Minute},
+		{"1h", time.Hour},
+		{"1h30m", 90 * time.Minute},
+	} {
+		if err := rsw.SetInterval(c.in); err != nil {
+			t.Errorf("SetInterval(%q) = %v", c.in, err)
+		} else if got := -rsw.interval; got != c.want {
+			t.Errorf("SetInterval(%q) set %s, want %s", c.in, got, c.want)
+		}
+	}
+	for _, in := range []string{"120", "5 minutes", "", "0s", "-5m"} {
+		if err := rsw.SetInterval(in); !errors.Is(err, ErrInvalidInterval) {
+			t.Errorf("SetInterval(%q) = %v, want ErrInvalidInterval", in, err)
+		}
+	}
+	if got := -rsw.interval; got != 90*time.Minute {
+		t.Errorf("invalid intervals changed the interval to %s", got)
+	}
+	if err := rsw.SetIntervalSeconds(0); !errors.Is(err, ErrInvalidInterval) {
+		t.Errorf("SetIntervalSeconds(0) = %v, want ErrInvalidInterval", err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	dl := NewMemoryMapFrom(map[string]string{"example.org": "1"})
+	tokens := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), dl, tokens)
+	rsw.SetDefaultLimit(1)
+	rlt := NewRatelimitToken("carol@example.com")
+
+	for _, set := range []func(){
+		func() {},
+		func() { rsw.SetLogger(nil); tokens.SetLogger(nil); rlt.SetLogger(nil) },
+	} {
+		set()
+		for _, s := range []string{"bob@example.com", "bob@example.org", "alice@example.net"} {
+			rsw.RateLimit(s, 1)
+			rsw.RateLimit(s, 1)
+		}
+		rlt.RecordMessage(time.Now(), 1)
+		rlt.Prune(time.Now().Add(time.Hour))
+		rsw.Report()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	wl := NewMemoryMapFrom(map[string]string{"alice@example.com": ""})
+	dl := NewMemoryMapFrom(map[string]string{"example.org": "1"})
+	rsw := NewRatelimitSlidingWindow(wl, dl, NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	rsw.RateLimit("alice@example.com", 1)
+	rsw.RateLimit("bob@example.com", 1)
+	rsw.RateLimit("bob@example.com", 1)
+	rsw.RateLimit("bob@example.org", 1)
+	rsw.RateLimit("bob@example.org", 1)
+	rsw.RateLimit("bob@example.org", 1)
+	want := Counters{Requests: 6, Whitelisted: 1, PermittedDomain: 1, PermittedDefault: 1, DeferredDomain: 2, DeferredDefault: 1}
+	m := rsw.Metrics()
+	if m.Counters != want {
+		t.Errorf("counters = %+v, want %+v", m.Counters, want)
+	}
+	if m.Tokens != 2 {
+		t.Errorf("tokens = %d, want 2", m.Tokens)
+	}
+	rsw.ResetCounters()
+	if c := rsw.Counters(); c != (Counters{}) {
+		t.Errorf("counters after a reset = %+v", c)
+	}
+}
+
+func TestTokenMapShards(t *testing.T) {
+	tokens := NewRatelimitTokenMap(8)
+	for i := 0; i < 800; i++ {
+		k := "user" + strconv.Itoa(i) + "@example.com"
+		if tokens.Token(k) != tokens.Token(k) {
+			t.Fatalf("%s got two tokens", k)
+		}
+	}
+	for i, sh := range tokens.shards {
+		if n := len(sh.tokens); n < 50 || n > 150 {
+			t.Errorf("shard %d holds %d of 800 tokens, want them spread evenly", i, n)
+		}
+	}
+	if n := tokens.len(); n != 800 {
+		t.Errorf("map holds %d tokens, want 800", n)
+	}
+}
+
+func BenchmarkTokenMapParallel(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "user" + strconv.Itoa(i) + "@example.com"
+	}
+	for _, shards := range []int{1, DefaultTokenShards} {
+		b.Run(strconv.Itoa(shards)+"shards", func(b *testing.B) {
+			tokens := NewRatelimitTokenMap(shards)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					tokens.Token(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestWildcardDomains(t *testing.T) {
+	dl := NewMemoryMapFrom(map[string]string{"*.example.com": "3"})
+	wl := NewMemoryMapFrom(map[string]string{"*.partner.org": ""})
+	rsw := NewRatelimitSlidingWindow(wl, dl, NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+
+	if got := rsw.RateLimit("bob@mail.partner.org", 2); got == "action=dunno\n\n" {
+		t.Error("a wildcard white list entry matched with wildcards off")
+	}
+	rsw.SetWildcardDomains(true)
+	if got := rsw.RateLimit("bob@mail.partner.org", 2); got != "action=dunno\n\n" {
+		t.Errorf("sender of a subdomain of a whitelisted wildcard = %q", got)
+	}
+	if got := rsw.RateLimit("bob@mail.example.com", 3); got != "action=dunno\n\n" {
+		t.Errorf("3 recipients under the wildcard domain limit of 3 = %q", got)
+	}
+	if got := rsw.RateLimit("bob@mail.example.com", 1); got == "action=dunno\n\n" {
+		t.Error("a message over the wildcard domain limit was permitted")
+	}
+}
+
+func TestLimitPrecedence(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		wl, sl, dl map[string]string
+		want       int // messages permitted before the first defer, capped at 20
+	}{
+		{"default", nil, nil, nil, 1},
+		{"domain", nil, nil, map[string]string{"example.com": "3"}, 3},
+		{"sender over domain", nil, map[string]string{"bob@example.com": "5"}, map[string]string{"example.com": "3"}, 5},
+		{"unlimited sender", nil, map[string]string{"bob@example.com": "0"}, map[string]string{"example.com": "3"}, 20},
+		{"white list first", map[string]string{"bob@example.com": ""}, map[string]string{"bob@example.com": "5"}, nil, 20},
+		{"other sender", nil, map[string]string{"alice@example.com": "5"}, map[string]string{"example.com": "3"}, 3},
+	} {
+		rsw := NewRatelimitSlidingWindow(NewMemoryMapFrom(c.wl), NewMemoryMapFrom(c.dl), NewRatelimitTokenMap(1))
+		rsw.SetDefaultLimit(1)
+		rsw.SetSenderList(NewMemoryMapFrom(c.sl))
+		n := 0
+		for n < 20 && rsw.RateLimit("bob@example.com", 1) == "action=dunno\n\n" {
+			n++
+		}
+		if n != c.want {
+			t.Errorf("%s: permitted %d messages, want %d", c.name, n, c.want)
+		}
+	}
+}
+
+func TestSenderListReload(t *testing.T) {
+	dl := NewMemoryMapFrom(map[string]string{"example.com": "3"})
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), dl, NewRatelimitTokenMap(1))
+	rsw.SetDefaultLimit(1)
+	rsw.SetSenderList(NewMemoryMapFrom(map[string]string{"bob@example.com": "5"}))
+
+	for i := 0; i < 4; i++ {
+		rsw.RateLimit("bob@example.com", 1)
+	}
+	rsw.SetSenderList(NewMemoryMapFrom(map[string]string{"bob@example.com": "6"}))
+	if got := rsw.RateLimit("bob@example.com", 2); got != "action=dunno\n\n" {
+		t.Errorf("2 more messages under the reloaded limit of 6 = %q", got)
+	}
+	rsw.SetSenderList(nil)
+	if got := rsw.RateLimit("bob@example.com", 1); got == "action=dunno\n\n" {
+		t.Error("message permitted over the domain limit once the sender list was removed")
+	}
+}
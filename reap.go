@@ -0,0 +1,85 @@
+package postfix
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reap drops the tokens left idle for olderThan, tokens the map did not hand out since and whose messages no longer count:
+// all their slices ended by then and their decaying count fell to zero. Tokens with an override in effect are kept.
+// olderThan should be at least the interval of the window, shorter ones drop senders whose slices are still counted,
+// only pruned when the sender sends again. It returns the number of tokens dropped.
+func (rlm *RatelimitTokenMap) Reap(olderThan time.Duration) int {
+	rlm.mu.Lock()
+	defer rlm.mu.Unlock()
+	now := rlm.now()
+	cutoff := now.Add(-olderThan)
+	n := 0
+	for _, sh := range rlm.shards {
+		sh.mu.Lock()
+		for k, t := range sh.tokens {
+			if t.used.After(cutoff) || !t.idle(cutoff, now) {
+				continue
+			}
+			delete(sh.tokens, k)
+			atomic.AddInt64(&rlm.n, -1)
+			n++
+		}
+		sh.mu.Unlock()
+	}
+	if n > 0 {
+		rlm.logger.Println("Reaped", n, "tokens idle for", olderThan, rlm.len(), "left")
+	}
+	rlm.checkHighWater()
+	return n
+}
+
+// StartReaper reaps the tokens idle for maxIdle every interval until stop is called
+func (rlm *RatelimitTokenMap) StartReaper(interval, maxIdle time.Duration) (stop func()) {
+	return every(interval, func() { rlm.Reap(maxIdle) })
+}
+
+// every calls f every interval in a goroutine of its own until stop is called, stop returns once f is no longer running
+func every(interval time.Duration, f func()) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				f()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// idle reports whether nothing of the token counts any more at cutoff, no slice ends after it and the decaying count
+// is zero, and it has no override in effect at now
+func (rlt *RatelimitToken) idle(cutoff, now time.Time) bool {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	for i := range rlt.tsd {
+		if rlt.start(i + 1).After(cutoff) {
+			return false
+		}
+	}
+	if math.Round(rlt.decayed(now)) > 0 {
+		return false
+	}
+	return rlt.overrideTo.IsZero() || !now.Before(rlt.overrideTo)
+}
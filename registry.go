@@ -0,0 +1,90 @@
+package postfix
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PolicyContextAttribute is the policy request attribute set by the policy_context parameter of postfix, used by
+// the Registry to pick the limiter of a request
+const PolicyContextAttribute = "policy_context"
+
+// Registry holds independent limiters by name, each with its own configuration, lists and tokens
+type Registry struct {
+	mu       sync.RWMutex
+	limiters map[string]*RatelimitSlidingWindow
+	fallback string
+}
+
+// NewRegistry creates a structure of type Registry
+func NewRegistry() *Registry {
+	var r Registry
+	r.limiters = make(map[string]*RatelimitSlidingWindow)
+	return &r
+}
+
+// Add adds a limiter under name, replacing the one already registered under it
+func (r *Registry) Add(name string, rsw *RatelimitSlidingWindow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limiters[name] = rsw
+}
+
+// Remove removes the limiter registered under name
+func (r *Registry) Remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.limiters, name)
+}
+
+// SetFallback sets the name of the limiter handling requests without a known name, none by default
+func (r *Registry) SetFallback(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = name
+}
+
+// Get returns the limiter registered under name, or the fallback limiter, or error if there is neither
+func (r *Registry) Get(name string) (*RatelimitSlidingWindow, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if rsw, ok := r.limiters[name]; ok {
+		return rsw, nil
+	}
+	if rsw, ok := r.limiters[r.fallback]; ok && r.fallback != "" {
+		return rsw, nil
+	}
+	return nil, fmt.Errorf("no limiter named %q", name)
+}
+
+// Names returns the names of the registered limiters in order
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]string, 0, len(r.limiters))
+	for k := range r.limiters {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Dispatch rate limits a policy request with the limiter registered under name
+func (r *Registry) Dispatch(name string, p *Policy) (string, error) {
+	rsw, err := r.Get(name)
+	if err != nil {
+		return "", err
+	}
+	return rsw.RateLimitRequest(p), nil
+}
+
+// RateLimitRequest rate limits a policy request with the limiter named by its policy_context attribute,
+// requests without a limiter are answered with dunno so the other restrictions decide
+func (r *Registry) RateLimitRequest(p *Policy) string {
+	res, err := r.Dispatch(p.Attribute(PolicyContextAttribute), p)
+	if err != nil {
+		return Action{Name: "dunno"}.String()
+	}
+	return res
+}
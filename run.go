@@ -0,0 +1,176 @@
+package postfix
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is how long Run waits for the requests being decided when shutting down
+const shutdownTimeout = 10 * time.Second
+
+// Config holds the settings of the rate limiting policy daemon started by Run
+type Config struct {
+	Network      string // tcp or unix
+	Address      string
+	WhiteList    string // map file names, optional
+	DomainList   string
+	DefaultLimit int
+	Interval     string // window length like 1h as accepted by SetInterval
+	DeferMessage string
+	TokenFile    string // when set tokens are loaded from it at start and saved to it at shutdown, see loadTokens
+	HealthAddr   string // when set a /healthz endpoint is served on this TCP address
+	Logger       *log.Logger
+}
+
+// Run loads the maps, serves policy requests and blocks until SIGINT or SIGTERM, SIGHUP reloads the maps keeping the token counts.
+// It wires the pieces of the package together the simplest way, build them by hand for anything more involved.
+func Run(cfg Config) error {
+	logger := orDiscard(cfg.Logger)
+
+	wl, err := loadMap(cfg.WhiteList)
+	if err != nil {
+		return err
+	}
+	dl, err := loadMap(cfg.DomainList)
+	if err != nil {
+		return err
+	}
+
+	tokens := NewRatelimitTokenMap(DefaultTokenShards)
+	tokens.SetLogger(logger)
+	rsw := NewRatelimitSlidingWindow(wl, dl, tokens)
+	rsw.SetLogger(logger)
+	if cfg.DefaultLimit > 0 {
+		rsw.SetDefaultLimit(cfg.DefaultLimit)
+	}
+	if err := rsw.SetInterval(cfg.Interval); err != nil {
+		return err
+	}
+	if cfg.DeferMessage != "" {
+		rsw.SetDeferMessage(cfg.DeferMessage)
+	}
+	if cfg.TokenFile != "" {
+		if err := loadTokens(rsw, cfg.TokenFile); err != nil {
+			logger.Println("Failed to restore tokens from", cfg.TokenFile, err.Error())
+		}
+	}
+
+	if cfg.Network == "unix" {
+		os.Remove(cfg.Address) // a stale socket of a previous run
+	}
+	l, err := net.Listen(cfg.Network, cfg.Address)
+	if err != nil {
+		return fmt.Errorf("listening on %s %s: %s", cfg.Network, cfg.Address, err)
+	}
+
+	ps := NewPolicyServer(rsw)
+	ps.SetLogger(logger)
+
+	if cfg.HealthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", rsw.HealthHandler())
+		hs := &http.Server{Addr: cfg.HealthAddr, Handler: mux}
+		go func() {
+			if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Println("Health endpoint failed:", err.Error())
+			}
+		}()
+		defer hs.Close()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- ps.Serve(l)
+	}()
+	logger.Println("Serving policy requests on", cfg.Network, cfg.Address)
+
+	for {
+		select {
+		case err := <-served:
+			return err
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				reloadMaps(rsw, cfg, logger)
+				continue
+			}
+			logger.Println("Shutting down on", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			ps.Shutdown(ctx)
+			cancel()
+			<-served
+			if cfg.TokenFile != "" {
+				if err := tokens.SaveSnapshot(cfg.TokenFile); err != nil {
+					return fmt.Errorf("saving tokens to %s: %s", cfg.TokenFile, err)
+				}
+			}
+			return nil
+		}
+	}
+}
+
+func reloadMaps(rsw *RatelimitSlidingWindow, cfg Config, logger *log.Logger) {
+	if wl, err := loadMap(cfg.WhiteList); err != nil {
+		rsw.ListReloadFailed(WhiteListName, err)
+	} else {
+		rsw.SetWhiteList(wl)
+	}
+	if dl, err := loadMap(cfg.DomainList); err != nil {
+		rsw.ListReloadFailed(DomainListName, err)
+	} else {
+		rsw.SetDomainList(dl)
+	}
+	logger.Println("Reloaded maps")
+}
+
+// loadTokens restores the tokens saved by a previous run, from a binary snapshot as written by SaveSnapshot or from a
+// file in the JSON format of Save or the text format of SaveTokens written by earlier versions. A missing or empty file
+// is not an error, there is nothing to restore on the first run.
+func loadTokens(rsw *RatelimitSlidingWindow, filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	b, err := br.Peek(1)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch b[0] {
+	case snapshotVersion:
+		return rsw.tokens.ReadSnapshot(br)
+	case '{':
+		return rsw.tokens.Load(br)
+	}
+	if !rsw.LoadTokens(filename) {
+		return fmt.Errorf("cannot read tokens in the format of SaveTokens")
+	}
+	return nil
+}
+
+// loadMap loads a map file like Load, no file name gives an empty map
+func loadMap(filename string) (*MemoryMap, error) {
+	if filename == "" {
+		return NewMemoryMap(), nil
+	}
+	return Load(filename)
+}
@@ -0,0 +1,68 @@
+package postfix
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTokensFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	formats := map[string]func(rsw *RatelimitSlidingWindow, name string) error{
+		"snapshot": func(rsw *RatelimitSlidingWindow, name string) error { return rsw.tokens.SaveSnapshot(name) },
+		"json": func(rsw *RatelimitSlidingWindow, name string) error {
+			f, err := os.Create(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return rsw.tokens.Save(f)
+		},
+		"legacy": func(rsw *RatelimitSlidingWindow, name string) error {
+			rsw.SaveTokens(name)
+			return nil
+		},
+	}
+	for format, save := range formats {
+		name := filepath.Join(dir, format)
+		saved := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+		saved.RateLimit("bob@example.com", 7)
+		if err := save(saved, name); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		restored := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+		if err := loadTokens(restored, name); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got := restored.tokens.Token("bob@example.com").Count(); got != 7 {
+			t.Errorf("%s: restored count %d, want 7", format, got)
+		}
+	}
+}
+
+func TestLoadTokensMissingOrEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), NewRatelimitTokenMap(1))
+
+	if err := loadTokens(rsw, filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("missing token file: %v", err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTokens(rsw, empty); err != nil {
+		t.Errorf("empty token file: %v", err)
+	}
+}
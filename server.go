@@ -0,0 +1,262 @@
+package postfix
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxRequestSize is the default limit of the size of a single policy request, real ones are well below a kilobyte
+const DefaultMaxRequestSize = 64 * 1024
+
+var errRequestTooLarge = errors.New("policy request too large")
+
+// policyResponder answers policy requests, a RateLimiter or a Registry of them
+type policyResponder interface {
+	RateLimitRequest(p *Policy) string
+}
+
+// PolicyServer answers postfix policy delegation requests with the decisions of a RateLimiter
+type PolicyServer struct {
+	oversized int64 // requests dropped for exceeding maxSize, updated atomically
+	maxSize   int64
+	timeout   int64 // read timeout of a request in nanoseconds, 0 for none, atomic
+	mu        sync.Mutex
+	limiter   policyResponder
+	listener  net.Listener
+	conns     map[net.Conn]bool // true while a request of the connection is being decided
+	handlers  sync.WaitGroup
+	closed    bool
+	logger    *log.Logger
+}
+
+// NewPolicyServer creates a structure of type PolicyServer answering with the decisions of l, a RatelimitSlidingWindow
+// or a RatelimitTokenBucket
+func NewPolicyServer(l RateLimiter) *PolicyServer {
+	return newPolicyServer(l)
+}
+
+// NewRegistryServer creates a PolicyServer answering every request with the limiter its policy_context names in the registry,
+// to pick a limiter by listening socket instead serve each socket with a server of its own limiter
+func NewRegistryServer(r *Registry) *PolicyServer {
+	return newPolicyServer(r)
+}
+
+func newPolicyServer(r policyResponder) *PolicyServer {
+	var ps PolicyServer
+	ps.limiter = r
+	ps.conns = make(map[net.Conn]bool)
+	ps.maxSize = DefaultMaxRequestSize
+	ps.logger = orDiscard(nil)
+	return &ps
+}
+
+// SetLogger sets the logger on the PolicyServer
+func (ps *PolicyServer) SetLogger(l *log.Logger) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.logger = orDiscard(l)
+}
+
+// SetMaxRequestSize sets the number of bytes a single request may take, connections sending larger ones are dropped
+func (ps *PolicyServer) SetMaxRequestSize(n int64) {
+	atomic.StoreInt64(&ps.maxSize, n)
+}
+
+// SetReadTimeout sets how long the server waits for the next request on a connection, including the time postfix leaves it
+// idle between requests, before closing it. Postfix opens a new connection for its next request. The default 0 waits forever.
+func (ps *PolicyServer) SetReadTimeout(d time.Duration) {
+	atomic.StoreInt64(&ps.timeout, int64(d))
+}
+
+// OversizedRequests returns the number of connections dropped because of requests larger than the maximum size
+func (ps *PolicyServer) OversizedRequests() int64 {
+	return atomic.LoadInt64(&ps.oversized)
+}
+
+// ListenAndServe listens on the tcp or unix address and handles the connections until Close or Shutdown is called
+func (ps *PolicyServer) ListenAndServe(network, address string) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return ps.Serve(l)
+}
+
+// Serve accepts connections on l and handles them until Close is called
+func (ps *PolicyServer) Serve(l net.Listener) error {
+	ps.mu.Lock()
+	if ps.closed {
+		ps.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	ps.listener = l
+	ps.mu.Unlock()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			ps.mu.Lock()
+			closed := ps.closed
+			ps.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if !ps.track(c) {
+			c.Close()
+			return nil
+		}
+		go ps.handle(c)
+	}
+}
+
+// Close stops accepting connections and closes the open ones
+func (ps *PolicyServer) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.closed = true
+	var err error
+	if ps.listener != nil {
+		err = ps.listener.Close()
+	}
+	for c := range ps.conns {
+		c.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and closes the idle ones, then waits for the requests being decided to be answered
+// before closing their connections too, so no message gets an error. Postfix opens a new connection for its next request.
+// If ctx is done first the remaining connections are closed regardless and the error of ctx is returned.
+func (ps *PolicyServer) Shutdown(ctx context.Context) error {
+	ps.mu.Lock()
+	ps.closed = true
+	var err error
+	if ps.listener != nil {
+		err = ps.listener.Close()
+	}
+	for c, busy := range ps.conns {
+		if !busy {
+			c.Close()
+		}
+	}
+	ps.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ps.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	abandoned := 0
+	for c, busy := range ps.conns {
+		if busy {
+			abandoned++
+		}
+		c.Close()
+	}
+	ps.logger.Println("WARNING: shutdown deadline reached, abandoning", abandoned, "connections with requests being decided")
+	return ctx.Err()
+}
+
+func (ps *PolicyServer) track(c net.Conn) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return false
+	}
+	ps.conns[c] = false
+	ps.handlers.Add(1)
+	return true
+}
+
+func (ps *PolicyServer) untrack(c net.Conn) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(ps.conns, c)
+	ps.handlers.Done()
+}
+
+// busy marks the connection as deciding a request or as idle again, it returns false once the server is closing
+// so the handler closes the connection instead of waiting for the next request
+func (ps *PolicyServer) busy(c net.Conn, b bool) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.conns[c] = b
+	return !ps.closed
+}
+
+// handle answers the requests of a connection, postfix keeps it open for several requests. A panic answering one only
+// closes its connection.
+func (ps *PolicyServer) handle(c net.Conn) {
+	defer ps.untrack(c)
+	defer c.Close()
+	defer func() {
+		if v := recover(); v != nil {
+			ps.logger.Println("ERROR: closing connection from", c.RemoteAddr(), "after a panic:", v)
+		}
+	}()
+
+	lr := &requestReader{r: c}
+	r := bufio.NewReader(lr)
+	for {
+		lr.remaining = atomic.LoadInt64(&ps.maxSize) - int64(r.Buffered()) // buffered bytes belong to the next request
+		if t := atomic.LoadInt64(&ps.timeout); t > 0 {
+			c.SetReadDeadline(time.Now().Add(time.Duration(t)))
+		}
+		req, err := ParsePolicyRequest(r)
+		if err != nil {
+			if errors.Is(err, errRequestTooLarge) {
+				atomic.AddInt64(&ps.oversized, 1)
+				ps.logger.Println("WARNING: dropping connection from", c.RemoteAddr(), "sending a request larger than", atomic.LoadInt64(&ps.maxSize), "bytes")
+				return
+			}
+			if err != io.EOF {
+				ps.logger.Println("Closing connection from", c.RemoteAddr(), "on error:", err.Error())
+			}
+			return
+		}
+		ps.busy(c, true) // a request read while shutting down is still answered
+		if _, err := io.WriteString(c, ps.limiter.RateLimitRequest(req)); err != nil {
+			ps.logger.Println("Failed to write response to", c.RemoteAddr(), err.Error())
+			return
+		}
+		if !ps.busy(c, false) {
+			return
+		}
+	}
+}
+
+// requestReader reads from r like io.LimitedReader, but fails once the remaining bytes of the current request are used up
+type requestReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (rr *requestReader) Read(p []byte) (int, error) {
+	if rr.remaining <= 0 {
+		return 0, errRequestTooLarge
+	}
+	if int64(len(p)) > rr.remaining {
+		p = p[:rr.remaining]
+	}
+	n, err := rr.r.Read(p)
+	rr.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,227 @@
+package postfix
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotVersion is the first byte of a binary snapshot, bump it whenever snapshotToken changes incompatibly
+const snapshotVersion = 1
+
+// snapshotToken is the record of a single token in a binary snapshot
+type snapshotToken struct {
+	Key    string
+	Starts []int64 // unix seconds of the slices, Counts holds their message counts
+	Counts []int
+	Decay  float64 // the decaying count at At and its time constant, zero if the token is accounted in slices
+	At     int64
+	Tau    int64
+}
+
+// WriteSnapshot writes the tokens in a compact binary format, a version byte followed by a gzip compressed stream of
+// gob encoded tokens. The map is only locked while the tokens are collected, they are encoded one at a time.
+func (rlm *RatelimitTokenMap) WriteSnapshot(w io.Writer) error {
+	tokens := rlm.all()
+	if _, err := w.Write([]byte{snapshotVersion}); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	enc := gob.NewEncoder(zw)
+	for _, t := range tokens {
+		if err := enc.Encode(t.snapshot()); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ReadSnapshot adds the tokens of a snapshot written by WriteSnapshot to the map, reading them one at a time and leaving out
+// the slices too old to count like Load
+func (rlm *RatelimitTokenMap) ReadSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	v, err := br.ReadByte()
+	if err != nil {
+		return fmt.Errorf("reading snapshot version: %s", err)
+	}
+	if v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	dec := gob.NewDecoder(zr)
+	cutoff := rlm.cutoff()
+	n, read := 0, 0
+	for {
+		var st snapshotToken
+		if err := dec.Decode(&st); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("reading snapshot token %d: %s", read+1, err)
+		}
+		read++
+		if rlm.restoreToken(st, cutoff) {
+			n++
+		}
+	}
+	rlm.logger.Println("Restored", n, "of", read, "tokens from snapshot")
+	return nil
+}
+
+// SaveSnapshot writes a binary snapshot of the tokens to filename, replacing it only once the snapshot is complete
+func (rlm *RatelimitTokenMap) SaveSnapshot(filename string) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if err := rlm.WriteSnapshot(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// LoadSnapshot adds the tokens of a binary snapshot file to the map
+func (rlm *RatelimitTokenMap) LoadSnapshot(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rlm.ReadSnapshot(f)
+}
+
+// tokenState is the JSON document written by Save
+type tokenState struct {
+	Version int
+	Tokens  []snapshotToken
+}
+
+// Save writes the tokens as JSON, with the unix time every slice starts at and its message count, to be restored with Load.
+// Save them on a clean shutdown and load them at startup, so a restart does not let senders who were near their limit
+// start over.
+func (rlm *RatelimitTokenMap) Save(w io.Writer) error {
+	tokens := rlm.all()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].key < tokens[j].key })
+	st := tokenState{Version: snapshotVersion, Tokens: make([]snapshotToken, len(tokens))}
+	for i, t := range tokens {
+		st.Tokens[i] = t.snapshot()
+	}
+	return json.NewEncoder(w).Encode(st)
+}
+
+// Load adds the tokens written by Save to the map. Slices that ended longer ago than the longest interval of the windows
+// using the map, their default interval or one from their domain list, no longer count and are left out, as are tokens
+// left without messages. Set up the windows before loading the tokens, otherwise all their slices are restored.
+func (rlm *RatelimitTokenMap) Load(r io.Reader) error {
+	var st tokenState
+	if err := json.NewDecoder(r).Decode(&st); err != nil {
+		return fmt.Errorf("reading tokens: %s", err)
+	}
+	if st.Version != snapshotVersion {
+		return fmt.Errorf("unsupported token state version %d", st.Version)
+	}
+	cutoff := rlm.cutoff()
+	n := 0
+	for _, t := range st.Tokens {
+		if rlm.restoreToken(t, cutoff) {
+			n++
+		}
+	}
+	rlm.logger.Println("Restored", n, "of", len(st.Tokens), "tokens")
+	return nil
+}
+
+// cutoff returns the unix time restored slices have to end after to still count, that of the longest interval of the
+// windows using the map before now, 0 keeping every slice if no window set a horizon
+func (rlm *RatelimitTokenMap) cutoff() int64 {
+	rlm.mu.Lock()
+	horizon := rlm.horizon
+	rlm.mu.Unlock()
+	if horizon <= 0 {
+		return 0
+	}
+	return rlm.now().Add(-horizon).Unix()
+}
+
+// restoreToken adds the slices of a snapshot token ending after cutoff to the map, reporting whether the token was
+// restored, a token left without messages is not
+func (rlm *RatelimitTokenMap) restoreToken(t snapshotToken, cutoff int64) bool {
+	rlm.mu.Lock()
+	slice := rlm.slice
+	rlm.mu.Unlock()
+	live := snapshotToken{Key: t.Key, Decay: t.Decay, At: t.At, Tau: t.Tau}
+	for i, s := range t.Starts {
+		if i < len(t.Counts) && s+int64(slice/time.Second) > cutoff {
+			live.Starts = append(live.Starts, s)
+			live.Counts = append(live.Counts, t.Counts[i])
+		}
+	}
+	if len(live.Starts) == 0 && live.Tau == 0 {
+		return false
+	}
+	rlm.Token(t.Key).restore(live)
+	return true
+}
+
+func (rlt *RatelimitToken) snapshot() snapshotToken {
+	rlt.mu.Lock()
+	defer rlt.mu.Unlock()
+	st := snapshotToken{
+		Key:    rlt.key,
+		Starts: make([]int64, 0, len(rlt.tsd)),
+		Counts: make([]int, 0, len(rlt.tsd)),
+		Decay:  math.Float64frombits(atomic.LoadUint64(&rlt.ewma)),
+		At:     atomic.LoadInt64(&rlt.ewmaAt),
+		Tau:    atomic.LoadInt64(&rlt.tau),
+	}
+	idx := make([]int64, 0, len(rlt.tsd))
+	for i := range rlt.tsd {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(a, b int) bool { return idx[a] < idx[b] })
+	for _, i := range idx {
+		st.Starts = append(st.Starts, rlt.start(i).Unix())
+		st.Counts = append(st.Counts, rlt.tsd[i])
+	}
+	return st
+}
+
+func (rlt *RatelimitToken) restore(st snapshotToken) {
+	for i, s := range st.Starts {
+		if i < len(st.Counts) {
+			rlt.record(time.Unix(s, 0), st.Counts[i], 0)
+		}
+	}
+	if st.Tau > 0 {
+		rlt.mu.Lock()
+		atomic.StoreUint64(&rlt.ewma, math.Float64bits(st.Decay))
+		atomic.StoreInt64(&rlt.ewmaAt, st.At)
+		atomic.StoreInt64(&rlt.tau, st.Tau)
+		rlt.mu.Unlock()
+	}
+}
@@ -0,0 +1,157 @@
+package postfix
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadCutoffManualClock(t *testing.T) {
+	at := time.Date(2001, 1, 1, 12, 0, 0, 0, time.UTC)
+	saved := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), saved)
+	rsw.SetClock(NewManualClock(at))
+	rsw.RateLimit("bob@example.com", 3)
+	var buf bytes.Buffer
+	if err := saved.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRatelimitTokenMap(1)
+	rsw = NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), restored)
+	rsw.SetClock(NewManualClock(at.Add(time.Minute)))
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Token("bob@example.com").Count(); got != 3 {
+		t.Errorf("restored count = %d, want the 3 messages still in the window of the clock", got)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	saved := NewRatelimitTokenMap(4)
+	for i := 0; i < 100; i++ {
+		saved.Token("user"+strconv.Itoa(i)+"@example.com").RecordMessage(time.Now(), i+1)
+	}
+	var buf bytes.Buffer
+	if err := saved.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRatelimitTokenMap(4)
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.len(); n != 100 {
+		t.Fatalf("restored %d tokens, want 100", n)
+	}
+	for i := 0; i < 100; i++ {
+		k := "user" + strconv.Itoa(i) + "@example.com"
+		if got := restored.Token(k).Count(); got != i+1 {
+			t.Errorf("restored count of %s = %d, want %d", k, got, i+1)
+		}
+	}
+}
+
+func TestReadSnapshotVersion(t *testing.T) {
+	restored := NewRatelimitTokenMap(1)
+	if err := restored.ReadSnapshot(bytes.NewReader([]byte{snapshotVersion + 1, 0})); err == nil {
+		t.Error("read a snapshot of an unknown version")
+	}
+	if err := restored.ReadSnapshot(bytes.NewReader(nil)); err == nil {
+		t.Error("read an empty snapshot")
+	}
+}
+
+func benchmarkSnapshot(b *testing.B, write func(*RatelimitTokenMap, io.Writer) error) {
+	tokens := NewRatelimitTokenMap(DefaultTokenShards)
+	now := time.Now()
+	for i := 0; i < 10000; i++ {
+		t := tokens.Token("user" + strconv.Itoa(i) + "@example.com")
+		for s := 0; s < 10; s++ {
+			t.RecordMessage(now.Add(-time.Duration(s)*time.Minute), 1)
+		}
+	}
+	var buf bytes.Buffer
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := write(tokens, &buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(buf.Len()), "bytes")
+}
+
+func BenchmarkWriteSnapshotBinary(b *testing.B) {
+	benchmarkSnapshot(b, (*RatelimitTokenMap).WriteSnapshot)
+}
+
+func BenchmarkWriteSnapshotJSON(b *testing.B) {
+	benchmarkSnapshot(b, (*RatelimitTokenMap).Save)
+}
+
+func TestReadSnapshotCutoffManualClock(t *testing.T) {
+	at := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	saved := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), saved)
+	mc := NewManualClock(at)
+	rsw.SetClock(mc)
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	rsw.RateLimit("bob@example.com", 3)
+	mc.Advance(5 * time.Minute)
+	rsw.RateLimit("alice@example.com", 2)
+	var buf bytes.Buffer
+	if err := saved.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRatelimitTokenMap(1)
+	rsw = NewRatelimitSlidingWindow(NewMemoryMap(), NewMemoryMap(), restored)
+	rsw.SetClock(NewManualClock(at.Add(12 * time.Minute)))
+	if err := rsw.SetInterval("10m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if tok, ok := restored.lookup("bob@example.com"); ok && tok.Count() != 0 {
+		t.Errorf("restored count = %d, want the messages past the window left out", tok.Count())
+	}
+	if got := restored.Token("alice@example.com").Count(); got != 2 {
+		t.Errorf("restored count = %d, want the 2 messages still in the window", got)
+	}
+}
+
+func TestLoadKeepsLongerDomainInterval(t *testing.T) {
+	at := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	dl := NewMemoryMapFrom(map[string]string{"example.com": "50 2h"})
+	saved := NewRatelimitTokenMap(1)
+	rsw := NewRatelimitSlidingWindow(NewMemoryMap(), dl, saved)
+	rsw.SetClock(NewManualClock(at))
+	rsw.RateLimit("bob@example.com", 3)
+	var buf bytes.Buffer
+	if err := saved.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewRatelimitTokenMap(1)
+	rsw = NewRatelimitSlidingWindow(NewMemoryMap(), dl, restored)
+	rsw.SetClock(NewManualClock(at.Add(time.Hour)))
+	if h := restored.horizon; h != 2*time.Hour {
+		t.Fatalf("horizon of a new window = %s, want the 2h interval of its domain list", h)
+	}
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Token("bob@example.com").Count(); got != 3 {
+		t.Errorf("restored count = %d, want the 3 messages still in the 2h window of the domain", got)
+	}
+}
@@ -0,0 +1,65 @@
+package postfix
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Validate checks cfg and its map files the way Run would use them, without listening or touching the token file,
+// and returns every problem found. Duplicate keys are only reported in the domain list, where they are conflicting
+// limits, a whitelist listing a sender twice is harmless.
+func Validate(cfg Config) []error {
+	var errs []error
+	switch cfg.Network {
+	case "tcp", "unix":
+	default:
+		errs = append(errs, fmt.Errorf("unsupported network %q, it must be tcp or unix", cfg.Network))
+	}
+	if cfg.Address == "" {
+		errs = append(errs, errors.New("no address to listen on"))
+	}
+	if cfg.DefaultLimit < 0 {
+		errs = append(errs, fmt.Errorf("%w: default limit %d is negative", ErrInvalidLimit, cfg.DefaultLimit))
+	}
+	if d, err := parseInterval(cfg.Interval); err != nil {
+		errs = append(errs, err)
+	} else if err := validateInterval(d, sliceDuration); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := loadMap(cfg.WhiteList); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.DomainList != "" {
+		errs = append(errs, validateLimits(cfg.DomainList)...)
+	}
+	return errs
+}
+
+// validateLimits checks that every limit of a map file parses and that no key is listed twice, in the order of the lines
+func validateLimits(filename string) []error {
+	f, err := openMap(filename)
+	if err != nil {
+		return []error{err}
+	}
+	defer f.Close()
+	mm, lines, err := loadReader(f, filename, true)
+	if err != nil {
+		return []error{err}
+	}
+	var errs []*MapError
+	for k, l := range lines {
+		for _, n := range l[1:] {
+			errs = append(errs, &MapError{File: filename, Line: n, Err: fmt.Errorf("%w: %s already listed at line %d", ErrDuplicateKey, k, l[0])})
+		}
+		if _, _, err := parseDomainLimit(mm.v[k]); err != nil {
+			errs = append(errs, &MapError{File: filename, Line: l[len(l)-1], Err: fmt.Errorf("limit of %s: %w", k, err)})
+		}
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	res := make([]error, len(errs))
+	for i, e := range errs {
+		res[i] = e
+	}
+	return res
+}
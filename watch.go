@@ -0,0 +1,72 @@
+package postfix
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// watchDebounce is how long a map file has to stay unchanged after a change before WatchMap reloads it
+const watchDebounce = 100 * time.Millisecond
+
+// WatchMap reloads m from filename with ReloadFrom whenever the file is written or replaced, like editors do by renaming
+// a new file over it, until stop is called. Changes are reported by the file system notifications of the directory of
+// the file where the system has them, inotify on Linux, and found by checking the file every watchInterval elsewhere.
+// A change is only reloaded once the file stayed the same for watchDebounce, so a burst of writes reloads the map once.
+// A failed reload is logged and keeps the old contents.
+func WatchMap(filename string, m *MemoryMap, logger *log.Logger) (stop func(), err error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, &MapError{File: filename, Err: err}
+	}
+	changes, closeWatch, err := watchFile(filename)
+	if err != nil {
+		return nil, &MapError{File: filename, Err: err}
+	}
+	logger = orDiscard(logger)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer closeWatch()
+		var settle <-chan time.Time // fires once the file stayed the same for watchDebounce
+		for {
+			select {
+			case <-done:
+				return
+			case _, ok := <-changes:
+				if !ok {
+					changes = nil // the notifications failed, nothing more will come
+					logger.Println("Stopped watching", filename)
+					continue
+				}
+				settle = time.After(watchDebounce)
+				continue
+			case <-settle:
+			}
+			settle = nil
+			if err := m.ReloadFrom(filename); err != nil {
+				logger.Println("Failed to reload", filename, err.Error())
+			} else {
+				logger.Println("Reloaded", filename, "with", m.Len(), "entries")
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}, nil
+}
+
+// notify sends a change on c unless one is waiting already
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
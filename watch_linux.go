@@ -0,0 +1,52 @@
+package postfix
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask are the inotify events of a directory telling a file in it was written or replaced
+const watchMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO
+
+// watchFile reports the changes of filename on the returned channel until the close func is called. It watches the
+// directory of the file with inotify, so a file renamed over it is seen like one written in place.
+func watchFile(filename string) (<-chan struct{}, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("inotify_init1", err)
+	}
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, watchMask); err != nil {
+		syscall.Close(fd)
+		return nil, nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	f := os.NewFile(uintptr(fd), "inotify") // non-blocking, so Close interrupts a pending Read
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				start := off + syscall.SizeofInotifyEvent
+				off = start + int(ev.Len)
+				name := bytes.TrimRight(buf[start:off], "\x00")
+				if string(name) == base || ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+					notify(changes)
+				}
+			}
+		}
+	}()
+	return changes, func() { f.Close() }, nil
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+package postfix
+
+import (
+	"os"
+	"time"
+)
+
+// watchInterval is how often the file is checked for changes where there are no file system notifications
+const watchInterval = time.Second
+
+// watchFile reports the changes of filename on the returned channel until the close func is called, checking the file
+// every watchInterval
+func watchFile(filename string) (<-chan struct{}, func(), error) {
+	last, err := os.Stat(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(watchInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+			cur, err := os.Stat(filename)
+			if err != nil {
+				continue // removed, or not renamed in place yet
+			}
+			if !sameFile(cur, last) {
+				last = cur
+				notify(changes)
+			}
+		}
+	}()
+	return changes, func() { close(done) }, nil
+}
+
+// sameFile reports whether a and b describe the same unchanged file
+func sameFile(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
@@ -0,0 +1,153 @@
+package postfix
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to log to from the goroutine of WatchMap while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor polls cond until it holds or a few seconds passed
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatchMapDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "whitelist")
+	if err := ioutil.WriteFile(name, []byte("a@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := MustLoad(name)
+	var logs syncBuffer
+	stop, err := WatchMap(name, m, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(name, []byte(fmt.Sprintf("b%d@example.com\n", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !waitFor(func() bool { _, err := m.Get("b4@example.com"); return err == nil }) {
+		t.Fatal("the map was not reloaded after the writes")
+	}
+	time.Sleep(2 * watchDebounce)
+	if n := strings.Count(logs.String(), "Reloaded"); n != 1 {
+		t.Errorf("reloaded %d times for a burst of writes, want once:\n%s", n, logs.String())
+	}
+	if m.Len() != 1 {
+		t.Errorf("map holds %d entries, want only the last write", m.Len())
+	}
+}
+
+func TestWatchMapRename(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "whitelist")
+	if err := ioutil.WriteFile(name, []byte("a@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := MustLoad(name)
+	stop, err := WatchMap(name, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	tmp := filepath.Join(dir, ".whitelist.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("b@example.com\nc@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return m.Len() == 2 }) {
+		t.Fatalf("the map was not reloaded after a file was renamed over it, %d entries", m.Len())
+	}
+	if _, err := m.Get("a@example.com"); err == nil {
+		t.Error("the entry of the replaced file is still there")
+	}
+
+	if err := ioutil.WriteFile(tmp, []byte("d@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { _, err := m.Get("d@example.com"); return err == nil }) {
+		t.Fatal("the map was not reloaded after a second rename, the watch was lost with the replaced file")
+	}
+}
+
+func TestWatchMapStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "postfix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "whitelist")
+	if err := ioutil.WriteFile(name, []byte("a@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := MustLoad(name)
+	stop, err := WatchMap(name, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	stop() // a second call is harmless
+
+	if err := ioutil.WriteFile(name, []byte("b@example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * watchDebounce)
+	if _, err := m.Get("a@example.com"); err != nil {
+		t.Error("the map was reloaded after stop")
+	}
+}
+
+func TestWatchMapMissingFile(t *testing.T) {
+	if _, err := WatchMap(filepath.Join(os.TempDir(), "postfix-missing-map"), NewMemoryMap(), nil); err == nil {
+		t.Error("WatchMap of a missing file succeeded")
+	}
+}